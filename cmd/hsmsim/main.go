@@ -0,0 +1,77 @@
+//go:build !production
+
+// Command hsmsim serves a simulated payShield HSM for local development.
+// Its default address and LMK match the defaults of the service and the
+// keys of config/keys.json.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/hsmsim"
+	log "github.com/go-kit/log"
+)
+
+var fs = flag.NewFlagSet("hsmsim", flag.ExitOnError)
+var addr = fs.String("addr", ":1500", "Host port listen address")
+var lmk = fs.String("lmk", hsmsim.DefaultLMK, "Test LMK, a double or triple length key in hexadecimal")
+var framing = fs.String("framing", "2-byte", "Message framing: 2-byte, 4-byte, stx-etx or none")
+var headerLength = fs.Int("header-length", broker.DefaultHeaderLength, "Length of the message header")
+var firmware = fs.String("firmware", hsmsim.DefaultFirmware, "Firmware number returned by NC")
+var faults = fs.String("faults", "", "Scenario file of the faults injected into the replies")
+
+func main() {
+	fs.Parse(os.Args[1:])
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	logger = log.With(logger, "ts", log.DefaultTimestamp)
+
+	sim, err := hsmsim.New(*lmk)
+	if err != nil {
+		logger.Log("lmk", "load", "err", err)
+		os.Exit(1)
+	}
+	sim.Firmware = *firmware
+
+	framer, err := broker.ParseFramer(*framing)
+	if err != nil {
+		logger.Log("framing", *framing, "err", err)
+		os.Exit(1)
+	}
+
+	var scenario *hsmsim.Scenario
+	if *faults != "" {
+		if scenario, err = hsmsim.LoadScenario(*faults); err != nil {
+			logger.Log("faults", "load", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		logger.Log("transport", "TCP", "during", "Listen", "err", err)
+		os.Exit(1)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		logger.Log("signal", <-c)
+		ln.Close()
+	}()
+
+	srv := &hsmsim.Server{
+		Simulator:    sim,
+		Framer:       framer,
+		HeaderLength: *headerLength,
+		Scenario:     scenario,
+		Logger:       logger,
+	}
+	logger.Log("transport", "TCP", "addr", *addr, "firmware", sim.Firmware)
+	logger.Log("exit", srv.Serve(ln))
+}
@@ -2,17 +2,25 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	http2 "net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
 	"github.com/andrei-cloud/pinservice/pkg/broker"
 	endpoint "github.com/andrei-cloud/pinservice/pkg/endpoint"
+	"github.com/andrei-cloud/pinservice/pkg/hsmtls"
 	http1 "github.com/andrei-cloud/pinservice/pkg/http"
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
 	"github.com/andrei-cloud/pinservice/pkg/pool"
 	service "github.com/andrei-cloud/pinservice/pkg/service"
 	endpoint1 "github.com/go-kit/kit/endpoint"
@@ -27,17 +35,48 @@ import (
 	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// hsmCloseDelay is longer than any HSM command stays in flight.
+const hsmCloseDelay = 10 * time.Second
+
 var tracer opentracinggo.Tracer
 var logger log.Logger
 
 // Define our flags. Your service probably won't need to bind listeners for
 // all* supported transports, but we do it here for demonstration purposes.
 var fs = flag.NewFlagSet("pin", flag.ExitOnError)
-var hsmAddr = fs.String("hsm-addr", ":1500", "Thales HSM address")
+var hsmAddr = fs.String("hsm-addr", ":1500", "Comma separated Thales HSM addresses with optional weights e.g. hsm1:1500=2,hsm2:1500")
+var hsmPools = poolList{}
+var hsmStrategy = fs.String("hsm-strategy", "round-robin", "HSM selection strategy: round-robin, least-pending or primary-standby")
+var hsmFailureThreshold = fs.Int("hsm-failure-threshold", 3, "Number of consecutive connection or timeout failures after which an HSM is taken out of rotation")
+var hsmRecoveryInterval = fs.Duration("hsm-recovery-interval", 5*time.Second, "Time an HSM is out of rotation before a trial command is sent to it")
+var hsmRetries = fs.Int("hsm-retries", 1, "Number of retries of idempotent HSM commands on another HSM")
+var hsmAttemptTimeout = fs.Duration("hsm-attempt-timeout", 2*time.Second, "Response timeout of a single HSM command attempt")
+var hsmFraming = fs.String("hsm-framing", "2-byte", "HSM message framing: 2-byte, 4-byte, stx-etx or none")
+var hsmMaxFrameSize = fs.Int("hsm-max-frame-size", broker.DefaultMaxFrameSize, "Largest length prefixed or STX/ETX framed HSM message read, longer ones close the connection")
+var hsmHeaderLength = fs.Int("hsm-header-length", broker.DefaultHeaderLength, "Length of the HSM message header, as configured on the HSM")
+var hsmMaxInFlight = fs.Int("hsm-max-inflight", 8, "Maximum number of outstanding HSM commands per connection")
+var hsmMinIdle = fs.Int("hsm-min-idle", 1, "Number of HSM connections per HSM opened at startup and kept ready")
+var hsmIdleTimeout = fs.Duration("hsm-idle-timeout", 5*time.Minute, "Idle time after which an HSM connection is closed")
+var hsmMaxLifetime = fs.Duration("hsm-max-lifetime", time.Hour, "Time after which an HSM connection is replaced")
+var hsmKeepalive = fs.Duration("hsm-keepalive", 30*time.Second, "Idle time after which an HSM connection is probed with NC, 0 disables the probes")
+var hsmQueueSize = fs.Int("hsm-queue-size", 64, "Number of HSM commands that may wait for a broker worker")
+var hsmMaxQueueWait = fs.Duration("hsm-max-queue-wait", 100*time.Millisecond, "Time an HSM command waits for room in a full queue before it is rejected")
+var hsmTLS = fs.Bool("hsm-tls", false, "Connect to the HSM over TLS")
+var hsmTLSCert = fs.String("hsm-tls-cert", "", "Client certificate file for mutual TLS to the HSM, reloaded on SIGHUP")
+var hsmTLSKey = fs.String("hsm-tls-key", "", "Client key file for mutual TLS to the HSM, reloaded on SIGHUP")
+var hsmTLSCA = fs.String("hsm-tls-ca", "", "CA bundle file trusted for the HSM certificate, reloaded on SIGHUP")
+var hsmTLSServerName = fs.String("hsm-tls-server-name", "", "Server name expected in the HSM certificate, the HSM host by default")
+var keyStorePath = fs.String("key-store", "config/keys.json", "Key store file with the keys under LMK")
+var binTablePath = fs.String("bin-table", "config/bins.json", "BIN table file, reloaded on SIGHUP")
+var shutdownGrace = fs.Duration("shutdown-grace", 10*time.Second, "Time given to the HTTP requests and then to the HSM commands in flight to finish on shutdown")
 var debugAddr = fs.String("debug-addr", ":8080", "Debug and metrics listen address")
 var httpAddr = fs.String("http-addr", ":8081", "HTTP listen address")
 var zipkinURL = fs.String("zipkin-url", "", "Enable Zipkin tracing via a collector URL e.g. http://localhost:9411/api/v1/spans")
 
+func init() {
+	fs.Var(hsmPools, "hsm-pool", "HSM pool of the BIN ranges as name=addr[=weight],... with the addresses as in -hsm-addr, repeatable")
+}
+
 func Run() {
 	fs.Parse(os.Args[1:])
 
@@ -69,33 +108,227 @@ func Run() {
 		tracer = opentracinggo.GlobalTracer()
 	}
 
+	reloaders := []func() error{}
+
 	//define pool factory function
-	factory := func(addr string) pool.Factory {
-		return func() (pool.PoolItem, error) {
-			return net.Dial("tcp", addr)
+	dial := (&net.Dialer{}).DialContext
+	if *hsmTLS {
+		tlsDialer, err := hsmtls.NewDialer(hsmtls.Config{
+			CertFile:   *hsmTLSCert,
+			KeyFile:    *hsmTLSKey,
+			CAFile:     *hsmTLSCA,
+			ServerName: *hsmTLSServerName,
+		})
+		if err != nil {
+			logger.Log("hsm-tls", "load", "err", err)
+			os.Exit(1)
+		}
+		dial = tlsDialer.DialContext
+		reloaders = append(reloaders, tlsDialer.Reload)
+	}
+	factory := func(addr string) pool.Factory[net.Conn] {
+		return func(ctx context.Context) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
 		}
 	}
 
-	logger.Log("pool", 2)
-	p := pool.NewPool(2, factory(*hsmAddr))
+	strategy, err := broker.ParseStrategy(*hsmStrategy)
+	if err != nil {
+		logger.Log("hsm-strategy", *hsmStrategy, "err", err)
+		os.Exit(1)
+	}
+	framer, err := broker.ParseFramer(*hsmFraming)
+	if err != nil {
+		logger.Log("hsm-framing", *hsmFraming, "err", err)
+		os.Exit(1)
+	}
+	switch f := framer.(type) {
+	case broker.LengthPrefixed:
+		f.MaxSize = *hsmMaxFrameSize
+		framer = f
+	case broker.STXETX:
+		f.MaxSize = *hsmMaxFrameSize
+		framer = f
+	}
+	newPool := func(addr string) pool.Pool[net.Conn] {
+		logger.Log("pool", 2, "hsm", addr)
+		return pool.NewPool(2, factory(addr),
+			pool.WithMinIdle[net.Conn](*hsmMinIdle),
+			pool.WithIdleTimeout[net.Conn](*hsmIdleTimeout),
+			pool.WithMaxLifetime[net.Conn](*hsmMaxLifetime),
+			// commands may still be in flight on a replaced connection
+			pool.WithCloseDelay[net.Conn](hsmCloseDelay),
+		)
+	}
 
-	logger.Log("broker", 2)
-	hsmBroker := broker.NewBroker(p, 2, logger)
-	defer hsmBroker.Close()
+	breakerChanges := prometheus.NewCounterFrom(prometheus1.CounterOpts{
+		Help:      "Number of HSM circuit breaker state changes.",
+		Name:      "breaker_changes_total",
+		Namespace: "cards",
+		Subsystem: "hsm",
+	}, []string{"pool", "hsm", "state"})
+	breakerState := prometheus.NewGaugeFrom(prometheus1.GaugeOpts{
+		Help:      "HSM circuit breaker state: 0 closed, 1 open, 2 half-open.",
+		Name:      "breaker_state",
+		Namespace: "cards",
+		Subsystem: "hsm",
+	}, []string{"pool", "hsm"})
 
-	brokerCtx, stopBroker := context.WithCancel(context.Background())
-	defer stopBroker()
+	retried := prometheus.NewCounterFrom(prometheus1.CounterOpts{
+		Help:      "Number of HSM commands retried on another HSM.",
+		Name:      "retries_total",
+		Namespace: "cards",
+		Subsystem: "hsm",
+	}, []string{"pool", "hsm", "command"})
 
-	go hsmBroker.Start(brokerCtx)
+	queueDepth := prometheus.NewGaugeFrom(prometheus1.GaugeOpts{
+		Help:      "Number of HSM commands waiting for a broker worker.",
+		Name:      "queue_depth",
+		Namespace: "cards",
+		Subsystem: "hsm",
+	}, []string{"pool"})
+	rejected := prometheus.NewCounterFrom(prometheus1.CounterOpts{
+		Help:      "Number of HSM commands rejected because the queue was full.",
+		Name:      "rejected_total",
+		Namespace: "cards",
+		Subsystem: "hsm",
+	}, []string{"pool"})
+
+	// one broker per HSM pool, the default pool is -hsm-addr
+	addrs := map[string]string{service.DefaultPool: *hsmAddr}
+	for name, list := range hsmPools {
+		addrs[name] = list
+	}
+	brokers := service.Brokers{}
+	hsmBrokers := map[string]hsmBroker{}
+	for name, list := range addrs {
+		targets, err := parseTargets(list, newPool)
+		if err != nil {
+			logger.Log("hsm-pool", name, "hsm-addr", list, "err", err)
+			os.Exit(1)
+		}
+		logger.Log("broker", 2, "pool", name, "strategy", *hsmStrategy)
+		b := broker.NewMultiBroker(targets, 2, log.With(logger, "pool", name),
+			broker.WithMaxInFlight(*hsmMaxInFlight),
+			broker.WithHeaderLength(*hsmHeaderLength),
+			broker.WithFramer(framer),
+			broker.WithStrategy(strategy),
+			broker.WithFailureThreshold(*hsmFailureThreshold),
+			broker.WithRecoveryInterval(*hsmRecoveryInterval),
+			broker.WithRetries(*hsmRetries),
+			broker.WithAttemptTimeout(*hsmAttemptTimeout),
+			broker.WithRetryMetrics(retried.With("pool", name)),
+			broker.WithBreakerMetrics(breakerChanges.With("pool", name), breakerState.With("pool", name)),
+			broker.WithKeepalive(*hsmKeepalive),
+			broker.WithQueueSize(*hsmQueueSize),
+			broker.WithMaxQueueWait(*hsmMaxQueueWait),
+			broker.WithQueueMetrics(queueDepth.With("pool", name), rejected.With("pool", name)),
+		)
+		brokers[name] = b
+		hsmBrokers[name] = b
+	}
 
-	svc := service.New(hsmBroker, getServiceMiddleware(logger))
+	keys, err := keystore.NewFileStore(*keyStorePath)
+	if err != nil {
+		logger.Log("keystore", *keyStorePath, "err", err)
+		os.Exit(1)
+	}
+
+	bins, err := bintable.NewFileTable(*binTablePath, bintable.WithPools(brokers.Pools()...))
+	if err != nil {
+		logger.Log("bintable", *binTablePath, "err", err)
+		os.Exit(1)
+	}
+
+	svc := service.New(brokers, keys, bins, getServiceMiddleware(logger))
 	eps := endpoint.New(svc, getEndpointMiddleware(logger))
 	g := createService(eps)
+	for _, b := range hsmBrokers {
+		initBroker(g, b)
+	}
 	initMetricsEndpoint(g)
+	initHSMStatusEndpoint(hsmBrokers)
+	reloaders = append(reloaders, keys.Reload, bins.Reload)
+	initReloadSignal(g, reloaders...)
 	initCancelInterrupt(g)
 	logger.Log("exit", g.Run())
 
 }
+
+// parseTargets parses the comma separated list of HSM addresses with
+// optional weights, e.g. "hsm1:1500=2,hsm2:1500".
+func parseTargets(list string, newPool func(addr string) pool.Pool[net.Conn]) ([]broker.Target, error) {
+	var targets []broker.Target
+	for _, item := range strings.Split(list, ",") {
+		addr, weight := strings.TrimSpace(item), 1
+		if i := strings.LastIndex(addr, "="); i >= 0 {
+			w, err := strconv.Atoi(addr[i+1:])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight of %q", item)
+			}
+			addr, weight = addr[:i], w
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("empty hsm address")
+		}
+		targets = append(targets, broker.Target{Name: addr, Pool: newPool(addr), Weight: weight})
+	}
+	return targets, nil
+}
+
+// poolList collects the repeatable -hsm-pool flags by pool name.
+type poolList map[string]string
+
+func (p poolList) String() string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + p[name]
+	}
+	return strings.Join(names, " ")
+}
+
+func (p poolList) Set(v string) error {
+	name, list, ok := strings.Cut(v, "=")
+	name = strings.TrimSpace(name)
+	switch {
+	case !ok || name == "" || list == "":
+		return fmt.Errorf("want name=addr[=weight],..., got %q", v)
+	case name == service.DefaultPool:
+		return fmt.Errorf("the %s pool is set with -hsm-addr", name)
+	}
+	if _, ok := p[name]; ok {
+		return fmt.Errorf("pool %q given twice", name)
+	}
+	p[name] = list
+	return nil
+}
+
+// hsmBroker is the broker of an HSM pool.
+type hsmBroker interface {
+	broker.Broker
+	Start(context.Context)
+	Shutdown(context.Context) error
+	Status() []broker.Status
+}
+
+// initBroker runs the HSM broker. It is added after the HTTP handler, so on
+// shutdown the HTTP listener is stopped before the broker is drained.
+func initBroker(g *group.Group, b hsmBroker) {
+	g.Add(func() error {
+		b.Start(context.Background())
+		return nil
+	}, func(error) {
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+		defer cancel()
+		if err := b.Shutdown(ctx); err != nil {
+			logger.Log("broker", "Shutdown", "err", err)
+		}
+	})
+}
 func initHttpHandler(endpoints endpoint.Endpoints, g *group.Group) {
 	options := defaultHttpOptions(logger, tracer)
 	// Add your http options here
@@ -105,11 +338,17 @@ func initHttpHandler(endpoints endpoint.Endpoints, g *group.Group) {
 	if err != nil {
 		logger.Log("transport", "HTTP", "during", "Listen", "err", err)
 	}
+	server := &http2.Server{Handler: httpHandler}
 	g.Add(func() error {
 		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		return http2.Serve(httpListener, httpHandler)
+		return server.Serve(httpListener)
 	}, func(error) {
-		httpListener.Close()
+		// stop the listener and let the requests in flight finish
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Log("transport", "HTTP", "during", "Shutdown", "err", err)
+		}
 	})
 
 }
@@ -153,6 +392,20 @@ func initMetricsEndpoint(g *group.Group) {
 		debugListener.Close()
 	})
 }
+
+// initHSMStatusEndpoint serves the state of the HSMs by pool, with the
+// firmware and LMK check value reported by the keepalive probes, on the
+// debug listener.
+func initHSMStatusEndpoint(brokers map[string]hsmBroker) {
+	http2.DefaultServeMux.HandleFunc("/hsm", func(w http2.ResponseWriter, r *http2.Request) {
+		status := make(map[string][]broker.Status, len(brokers))
+		for name, b := range brokers {
+			status[name] = b.Status()
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(status)
+	})
+}
 func initCancelInterrupt(g *group.Group) {
 	cancelInterrupt := make(chan struct{})
 	g.Add(func() error {
@@ -168,3 +421,29 @@ func initCancelInterrupt(g *group.Group) {
 		close(cancelInterrupt)
 	})
 }
+
+// initReloadSignal reloads the key store, the BIN table and the HSM TLS
+// certificates on SIGHUP.
+func initReloadSignal(g *group.Group, reloaders ...func() error) {
+	cancelReload := make(chan struct{})
+	g.Add(func() error {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				for _, reload := range reloaders {
+					if err := reload(); err != nil {
+						logger.Log("during", "reload", "err", err)
+					}
+				}
+				logger.Log("reload", "done")
+			case <-cancelReload:
+				return nil
+			}
+		}
+	}, func(error) {
+		close(cancelReload)
+	})
+}
@@ -21,20 +21,32 @@ func createService(endpoints endpoint.Endpoints) (g *group.Group) {
 }
 func defaultHttpOptions(logger log.Logger, tracer opentracinggo.Tracer) map[string][]http.ServerOption {
 	options := map[string][]http.ServerOption{
-		"GeneratePVV": {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "GeneratePVV", logger))},
-		"Verify":      {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "Verify", logger))},
+		"GeneratePVV":      {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "GeneratePVV", logger))},
+		"Verify":           {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "Verify", logger))},
+		"GenerateOffset":   {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "GenerateOffset", logger))},
+		"VerifyOffset":     {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "VerifyOffset", logger))},
+		"TranslatePIN":     {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "TranslatePIN", logger))},
+		"VerifyComparison": {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "VerifyComparison", logger))},
+		"StorePIN":         {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "StorePIN", logger))},
+		"ChangePIN":        {http.ServerErrorEncoder(http1.ErrorEncoder), http.ServerErrorLogger(logger), http.ServerBefore(opentracing.HTTPToContext(tracer, "ChangePIN", logger))},
 	}
 	return options
 }
 func addDefaultEndpointMiddleware(logger log.Logger, duration *prometheus.Summary, mw map[string][]endpoint1.Middleware) {
 	mw["Verify"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "Verify")), endpoint.InstrumentingMiddleware(duration.With("method", "Verify"))}
 	mw["GeneratePVV"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "GeneratePVV")), endpoint.InstrumentingMiddleware(duration.With("method", "GeneratePVV"))}
+	mw["GenerateOffset"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "GenerateOffset")), endpoint.InstrumentingMiddleware(duration.With("method", "GenerateOffset"))}
+	mw["VerifyOffset"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "VerifyOffset")), endpoint.InstrumentingMiddleware(duration.With("method", "VerifyOffset"))}
+	mw["TranslatePIN"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "TranslatePIN")), endpoint.InstrumentingMiddleware(duration.With("method", "TranslatePIN"))}
+	mw["VerifyComparison"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "VerifyComparison")), endpoint.InstrumentingMiddleware(duration.With("method", "VerifyComparison"))}
+	mw["StorePIN"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "StorePIN")), endpoint.InstrumentingMiddleware(duration.With("method", "StorePIN"))}
+	mw["ChangePIN"] = []endpoint1.Middleware{endpoint.LoggingMiddleware(log.With(logger, "method", "ChangePIN")), endpoint.InstrumentingMiddleware(duration.With("method", "ChangePIN"))}
 }
 func addDefaultServiceMiddleware(logger log.Logger, mw []service.Middleware) []service.Middleware {
 	return append(mw, service.LoggingMiddleware(logger))
 }
 func addEndpointMiddlewareToAllMethods(mw map[string][]endpoint1.Middleware, m endpoint1.Middleware) {
-	methods := []string{"Verify", "GeneratePVV"}
+	methods := []string{"Verify", "GeneratePVV", "GenerateOffset", "VerifyOffset", "TranslatePIN", "VerifyComparison", "StorePIN", "ChangePIN"}
 	for _, v := range methods {
 		mw[v] = append(mw[v], m)
 	}
@@ -0,0 +1,199 @@
+package bintable
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andrei-cloud/pinservice/pkg/domain"
+)
+
+var (
+	ErrNotFound     = errors.New("bin range not found")
+	ErrInvalidRange = errors.New("invalid bin range")
+)
+
+// PIN verification methods.
+const (
+	MethodVisaPVV    = "visa-pvv"
+	MethodIBMOffset  = "ibm-offset"
+	MethodComparison = "comparison"
+)
+
+// Range describes how the PINs of the cards in the PAN prefix range are
+// verified. The longest matching prefix wins.
+type Range struct {
+	Prefix string        `json:"prefix"`
+	Method string        `json:"method"`
+	PVK    domain.KeyRef `json:"pvk"`
+	PVKI   string        `json:"pvki,omitempty"`
+	Pool   string        `json:"pool,omitempty"`
+
+	MinPINLength int `json:"min_pin_length,omitempty"`
+	MaxPINLength int `json:"max_pin_length,omitempty"`
+	// WeakPINChecks is the number of weak PINs, the most common first, that
+	// a new PIN is compared with on a PIN change. Each costs an HSM command
+	// on top of the two of the change, the check stops at the first match.
+	// The default is DefaultWeakPINChecks, -1 disables the check.
+	WeakPINChecks int `json:"weak_pin_checks,omitempty"`
+
+	// IBM 3624 offset parameters.
+	DecimalisationTable string `json:"decimalisation_table,omitempty"`
+	CheckLength         int    `json:"check_length,omitempty"`
+}
+
+// DefaultWeakPINChecks covers the ascending digits from 1 and 0 and the
+// repeated digits.
+const DefaultWeakPINChecks = 12
+
+// Table looks up the range of the PAN.
+type Table interface {
+	Lookup(pan string) (Range, error)
+}
+
+type table struct {
+	sync.RWMutex
+	ranges map[string]Range
+	// prefix lengths in descending order
+	lengths []int
+	// pools are the HSM pools the ranges may name, any if nil
+	pools map[string]bool
+}
+
+// Option configures a FileTable.
+type Option func(*table)
+
+// WithPools rejects the tables with a range naming an HSM pool other than
+// the given ones. The ranges without a pool use the default pool.
+func WithPools(names ...string) Option {
+	return func(t *table) {
+		t.pools = make(map[string]bool, len(names))
+		for _, name := range names {
+			t.pools[name] = true
+		}
+	}
+}
+
+// NewTable returns a Table of the given ranges.
+func NewTable(ranges ...Range) (*table, error) {
+	t := &table{}
+	if err := t.set(ranges); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *table) Lookup(pan string) (Range, error) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, l := range t.lengths {
+		if l > len(pan) {
+			continue
+		}
+		if r, ok := t.ranges[pan[:l]]; ok {
+			return r, nil
+		}
+	}
+	return Range{}, ErrNotFound
+}
+
+func (t *table) set(ranges []Range) error {
+	m := make(map[string]Range, len(ranges))
+	seen := map[int]bool{}
+	lengths := []int{}
+	for _, r := range ranges {
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if r.Pool != "" && t.pools != nil && !t.pools[r.Pool] {
+			return fmt.Errorf("%s: unknown hsm pool %q: %w", r.Prefix, r.Pool, ErrInvalidRange)
+		}
+		if _, ok := m[r.Prefix]; ok {
+			return fmt.Errorf("%s is duplicated: %w", r.Prefix, ErrInvalidRange)
+		}
+		m[r.Prefix] = r
+		if !seen[len(r.Prefix)] {
+			seen[len(r.Prefix)] = true
+			lengths = append(lengths, len(r.Prefix))
+		}
+	}
+	// longest prefix first
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+
+	t.Lock()
+	t.ranges, t.lengths = m, lengths
+	t.Unlock()
+	return nil
+}
+
+func (r *Range) validate() error {
+	if r.Prefix == "" || strings.Trim(r.Prefix, "0123456789") != "" {
+		return fmt.Errorf("prefix %q: %w", r.Prefix, ErrInvalidRange)
+	}
+	switch r.Method {
+	case MethodVisaPVV, MethodIBMOffset, MethodComparison:
+	default:
+		return fmt.Errorf("%s: method %q: %w", r.Prefix, r.Method, ErrInvalidRange)
+	}
+	if r.Method != MethodComparison && r.PVK.Name == "" {
+		return fmt.Errorf("%s: pvk is missing: %w", r.Prefix, ErrInvalidRange)
+	}
+	if r.PVKI == "" {
+		r.PVKI = "1"
+	}
+	if len(r.PVKI) != 1 || r.PVKI < "0" || r.PVKI > "6" {
+		return fmt.Errorf("%s: pvki %q: %w", r.Prefix, r.PVKI, ErrInvalidRange)
+	}
+	if r.MinPINLength == 0 {
+		r.MinPINLength = 4
+	}
+	if r.MaxPINLength == 0 {
+		r.MaxPINLength = 12
+	}
+	if r.MinPINLength < 4 || r.MaxPINLength > 12 || r.MinPINLength > r.MaxPINLength {
+		return fmt.Errorf("%s: pin length %d-%d: %w", r.Prefix, r.MinPINLength, r.MaxPINLength, ErrInvalidRange)
+	}
+	if r.WeakPINChecks == 0 {
+		r.WeakPINChecks = DefaultWeakPINChecks
+	}
+	if r.WeakPINChecks < -1 {
+		return fmt.Errorf("%s: weak pin checks %d: %w", r.Prefix, r.WeakPINChecks, ErrInvalidRange)
+	}
+	return nil
+}
+
+// FileTable is a Table loaded from a JSON file holding the list of ranges.
+type FileTable struct {
+	table
+	path string
+}
+
+// NewFileTable loads the ranges from the file at path.
+func NewFileTable(path string, opts ...Option) (*FileTable, error) {
+	t := &FileTable{path: path}
+	for _, opt := range opts {
+		opt(&t.table)
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload reads the range file again. The ranges in use are kept if the file
+// can't be loaded.
+func (t *FileTable) Reload() error {
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	var ranges []Range
+	if err = json.Unmarshal(data, &ranges); err != nil {
+		return fmt.Errorf("%s: %w", t.path, err)
+	}
+	return t.set(ranges)
+}
@@ -0,0 +1,39 @@
+package bintable_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
+)
+
+func TestUnknownPool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bins.json")
+	write := func(pool string) {
+		t.Helper()
+		data := `[{"prefix": "423407", "method": "comparison", "pool": "` + pool + `"}]`
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("backup")
+	if _, err := bintable.NewFileTable(path, bintable.WithPools("default")); !errors.Is(err, bintable.ErrInvalidRange) {
+		t.Fatalf("load: got %v, want ErrInvalidRange", err)
+	}
+
+	write("default")
+	bins, err := bintable.NewFileTable(path, bintable.WithPools("default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("backup")
+	if err := bins.Reload(); !errors.Is(err, bintable.ErrInvalidRange) {
+		t.Fatalf("reload: got %v, want ErrInvalidRange", err)
+	}
+	if r, err := bins.Lookup("4234070000000102"); err != nil || r.Pool != "default" {
+		t.Errorf("after the failed reload: got %+v, %v", r, err)
+	}
+}
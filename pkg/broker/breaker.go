@@ -0,0 +1,105 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the state of the circuit breaker of an HSM target.
+type State int
+
+const (
+	// Closed lets the commands through and counts the consecutive
+	// connection and timeout failures.
+	Closed State = iota
+	// Open takes the HSM out of rotation until the recovery interval has
+	// passed.
+	Open
+	// HalfOpen lets a single trial command through. Its success closes the
+	// breaker, its failure opens it again.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuit is the circuit breaker of an HSM target.
+type circuit struct {
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trialAt  time.Time
+}
+
+// allows reports whether a command may be sent: always when closed, once
+// the recovery interval has passed when open, and when no trial is in
+// flight when half-open. A trial whose outcome is lost, e.g. because its
+// caller went away, is given up after the recovery interval.
+func (c *circuit) allows(now time.Time, interval time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case Open:
+		return now.Sub(c.openedAt) >= interval
+	case HalfOpen:
+		return now.Sub(c.trialAt) >= interval
+	}
+	return true
+}
+
+// begin records that a command is sent and half-opens an open breaker
+// whose recovery interval has passed. It returns the previous and the new
+// state.
+func (c *circuit) begin(now time.Time) (State, State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from := c.state
+	if c.state != Closed {
+		c.state = HalfOpen
+		c.trialAt = now
+	}
+	return from, c.state
+}
+
+// failure counts a connection or timeout failure. It opens the breaker
+// after the consecutive failure threshold, or at once when half-open. It
+// returns the previous and the new state.
+func (c *circuit) failure(now time.Time, threshold int) (State, State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from := c.state
+	c.failures++
+	if c.state == HalfOpen || (c.state == Closed && c.failures >= threshold) {
+		c.state = Open
+		c.openedAt = now
+	}
+	return from, c.state
+}
+
+// success resets the failures and closes the breaker. It returns the
+// previous and the new state.
+func (c *circuit) success() (State, State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from := c.state
+	c.failures = 0
+	c.state = Closed
+	return from, c.state
+}
+
+// State returns the current state of the breaker.
+func (c *circuit) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
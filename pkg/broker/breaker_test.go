@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+func TestHalfOpenSingleTrial(t *testing.T) {
+	b := NewMultiBroker([]Target{{Name: "hsm"}}, 1, log.NewNopLogger(),
+		WithRecoveryInterval(time.Minute))
+	hsm := b.targets[0]
+	hsm.state = Open
+	hsm.openedAt = time.Now().Add(-time.Minute)
+
+	var (
+		wg     sync.WaitGroup
+		trials int64
+		start  = make(chan struct{})
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if b.pick(map[*target]bool{}) != nil {
+				atomic.AddInt64(&trials, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if trials != 1 {
+		t.Errorf("%d trials sent, want 1", trials)
+	}
+	if s := hsm.State(); s != HalfOpen {
+		t.Errorf("breaker is %s, want %s", s, HalfOpen)
+	}
+}
@@ -1,23 +1,37 @@
 package broker
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/andrei-cloud/pinservice/pkg/pool"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
 	"golang.org/x/sync/errgroup"
 )
 
-var ErrTimeout = fmt.Errorf("timeout on response")
+var (
+	ErrTimeout    = fmt.Errorf("timeout on response")
+	ErrOverloaded = errors.New("broker queue is full")
 
-const taskIDSize = 4
+	ErrShuttingDown = errors.New("broker is shutting down")
+	ErrNoTaskID     = errors.New("no free task id")
+)
+
+// DefaultHeaderLength is the length of the message header that correlates
+// the responses with their tasks.
+const DefaultHeaderLength = 4
 
 type Broker interface {
 	Send([]byte) ([]byte, error)
+	SendContext(context.Context, []byte) ([]byte, error)
 }
 
 type Logger interface {
@@ -25,10 +39,17 @@ type Logger interface {
 }
 
 type Task struct {
+	ctx      context.Context
 	taskID   string
 	request  []byte
 	response chan []byte
 	errCh    chan error
+
+	// session is the connection the task is in flight on since sent.
+	session *session
+	sent    time.Time
+	// exclude holds the targets of the previous attempts.
+	exclude map[*target]bool
 }
 
 type PendingList map[string]*Task
@@ -36,30 +57,249 @@ type PendingList map[string]*Task
 type broker struct {
 	sync.Mutex
 	workers      int
-	connPool     pool.Pool
+	targets      []*target
 	requestQueue chan *Task
 	pending      PendingList
+	sessions     map[net.Conn]*session
 	quit         chan struct{}
 
+	// closing stops new tasks, active counts the tasks being sent
+	closing   bool
+	active    sync.WaitGroup
+	closeOnce sync.Once
+
 	logger Logger
 
-	timeout time.Duration
+	timeout     time.Duration
+	maxInFlight int
+
+	pickMu           sync.Mutex
+	strategy         Strategy
+	failureThreshold int
+	recoveryInterval time.Duration
+	breakerChanges   metrics.Counter
+	breakerState     metrics.Gauge
+
+	retries        int
+	attemptTimeout time.Duration
+	retried        metrics.Counter
+
+	keepalive time.Duration
+
+	framer Framer
+	// headerLength is the length of the task IDs, seq the next one
+	headerLength int
+	seq          uint64
+
+	queueSize    int
+	maxQueueWait time.Duration
+	queueDepth   metrics.Gauge
+	rejected     metrics.Counter
+}
+
+// Option configures the broker.
+type Option func(*broker)
+
+// WithTimeout sets the response timeout of the requests sent without a
+// deadline. The default is 5 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(b *broker) {
+		b.timeout = d
+	}
+}
+
+// WithMaxInFlight sets the number of commands that may be outstanding on a
+// connection at once. The default is 1, i.e. no pipelining.
+func WithMaxInFlight(n int) Option {
+	return func(b *broker) {
+		if n > 0 {
+			b.maxInFlight = n
+		}
+	}
+}
+
+// WithStrategy sets how the HSM of a task is selected. The default is
+// RoundRobin.
+func WithStrategy(s Strategy) Option {
+	return func(b *broker) {
+		b.strategy = s
+	}
+}
+
+// WithFailureThreshold sets the number of consecutive connection or timeout
+// failures after which an HSM is taken out of rotation. The default is 3.
+func WithFailureThreshold(n int) Option {
+	return func(b *broker) {
+		if n > 0 {
+			b.failureThreshold = n
+		}
+	}
+}
+
+// WithRecoveryInterval sets how long the breaker of a failing HSM stays open
+// before a trial command is let through. The default is 5 seconds.
+func WithRecoveryInterval(d time.Duration) Option {
+	return func(b *broker) {
+		if d > 0 {
+			b.recoveryInterval = d
+		}
+	}
+}
+
+// WithBreakerMetrics sets the counter of the breaker state changes, labelled
+// with "hsm" and "state", and the gauge of the breaker state, labelled with
+// "hsm".
+func WithBreakerMetrics(changes metrics.Counter, state metrics.Gauge) Option {
+	return func(b *broker) {
+		b.breakerChanges = changes
+		b.breakerState = state
+	}
+}
+
+// WithRetries sets how many times an idempotent command that failed after
+// being written is retried on another HSM. The default is 1.
+func WithRetries(n int) Option {
+	return func(b *broker) {
+		if n >= 0 {
+			b.retries = n
+		}
+	}
+}
+
+// WithRetryMetrics sets the counter of the retried commands, labelled with
+// the "hsm" that failed and the "command".
+func WithRetryMetrics(retried metrics.Counter) Option {
+	return func(b *broker) {
+		b.retried = retried
+	}
+}
+
+// WithAttemptTimeout sets the response timeout of a single attempt, so that
+// an idempotent command may be retried on another HSM within the deadline
+// of the request. The default is no attempt timeout.
+func WithAttemptTimeout(d time.Duration) Option {
+	return func(b *broker) {
+		b.attemptTimeout = d
+	}
+}
+
+// WithKeepalive sets the idle time after which a pooled HSM connection is
+// probed with the NC diagnostics command. Connections failing the probe are
+// dropped. A probe does not count as use of the connection, so the idle
+// timeout of the pool still closes it. The default is no keepalive.
+func WithKeepalive(d time.Duration) Option {
+	return func(b *broker) {
+		b.keepalive = d
+	}
+}
+
+// WithQueueSize sets the number of tasks that may wait for a worker. The
+// default is the number of workers.
+func WithQueueSize(n int) Option {
+	return func(b *broker) {
+		if n > 0 {
+			b.queueSize = n
+		}
+	}
+}
+
+// WithMaxQueueWait sets how long a task waits for room in a full queue
+// before it is rejected with ErrOverloaded. The default is to reject it at
+// once.
+func WithMaxQueueWait(d time.Duration) Option {
+	return func(b *broker) {
+		b.maxQueueWait = d
+	}
 }
 
-func NewBroker(cp pool.Pool, n int, l Logger) *broker {
-	return &broker{
-		workers:      n,
-		connPool:     cp,
-		requestQueue: make(chan *Task, n),
-		pending:      make(PendingList),
-		quit:         make(chan struct{}),
+// WithQueueMetrics sets the gauge of the queue depth and the counter of the
+// tasks rejected with ErrOverloaded.
+func WithQueueMetrics(depth metrics.Gauge, rejected metrics.Counter) Option {
+	return func(b *broker) {
+		b.queueDepth = depth
+		b.rejected = rejected
+	}
+}
 
-		logger:  l,
-		timeout: 5 * time.Second,
+// WithFramer sets the framing of the messages on the HSM connections. The
+// default is TwoByteLength.
+func WithFramer(f Framer) Option {
+	return func(b *broker) {
+		b.framer = f
 	}
 }
 
+// WithHeaderLength sets the length of the message header, from 1 to 12
+// characters, as configured on the HSM. The default is DefaultHeaderLength.
+func WithHeaderLength(n int) Option {
+	return func(b *broker) {
+		if n > 0 && n <= maxHeaderLength {
+			b.headerLength = n
+		}
+	}
+}
+
+// NewBroker returns a broker sending the requests to the single HSM of the
+// connection pool.
+func NewBroker(cp pool.Pool[net.Conn], n int, l Logger, opts ...Option) *broker {
+	return NewMultiBroker([]Target{{Name: "hsm", Pool: cp, Weight: 1}}, n, l, opts...)
+}
+
+// NewMultiBroker returns a broker balancing the requests over the HSM
+// targets with the strategy of the options. Targets without a weight get a
+// weight of 1.
+func NewMultiBroker(targets []Target, n int, l Logger, opts ...Option) *broker {
+	b := &broker{
+		workers:  n,
+		pending:  make(PendingList),
+		sessions: make(map[net.Conn]*session),
+		quit:     make(chan struct{}),
+
+		logger:      l,
+		timeout:     5 * time.Second,
+		maxInFlight: 1,
+
+		strategy:         RoundRobin,
+		failureThreshold: 3,
+		recoveryInterval: 5 * time.Second,
+		breakerChanges:   discard.NewCounter(),
+		breakerState:     discard.NewGauge(),
+
+		retries:      1,
+		retried:      discard.NewCounter(),
+		framer:       TwoByteLength,
+		headerLength: DefaultHeaderLength,
+
+		queueSize:  n,
+		queueDepth: discard.NewGauge(),
+		rejected:   discard.NewCounter(),
+	}
+	for _, t := range targets {
+		if t.Weight <= 0 {
+			t.Weight = 1
+		}
+		b.targets = append(b.targets, &target{Target: t})
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.requestQueue = make(chan *Task, b.queueSize)
+	return b
+}
+
+// Start runs the workers until the context is done or the broker is shut
+// down.
 func (b *broker) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-b.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	eg := &errgroup.Group{}
 
 	for i := 0; i < b.workers; i++ {
@@ -67,127 +307,524 @@ func (b *broker) Start(ctx context.Context) {
 			return b.worker(ctx)
 		})
 	}
-	if err := eg.Wait(); err != nil {
+	if b.keepalive > 0 {
+		eg.Go(func() error {
+			return b.keepaliveLoop(ctx)
+		})
+	}
+	if err := eg.Wait(); err != nil && !errors.Is(err, context.Canceled) {
 		b.logger.Log("error", err)
 	}
 }
 
+// Shutdown stops accepting tasks and lets the queued and in-flight tasks
+// finish until the context is done. The tasks left then fail with
+// ErrShuttingDown. The workers are stopped and the pools are closed last.
+// It returns the context error if tasks were left.
+func (b *broker) Shutdown(ctx context.Context) error {
+	b.Lock()
+	b.closing = true
+	b.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.active.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		b.failAll(ErrShuttingDown)
+	}
+
+	b.closeOnce.Do(func() {
+		close(b.quit)
+		b.Lock()
+		sessions := make([]*session, 0, len(b.sessions))
+		for _, s := range b.sessions {
+			sessions = append(sessions, s)
+		}
+		b.Unlock()
+		for _, s := range sessions {
+			s.close(ErrShuttingDown)
+		}
+		for _, t := range b.targets {
+			t.Pool.Close()
+		}
+	})
+	return err
+}
+
+// Close shuts the broker down without waiting for the tasks.
 func (b *broker) Close() {
-	close(b.quit)
-	b.connPool.Close()
-	for _, t := range b.pending {
-		close(t.response)
-		close(t.errCh)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Shutdown(ctx)
+}
+
+// failAll fails the tasks in flight and in the queue.
+func (b *broker) failAll(err error) {
+	b.Lock()
+	for id, task := range b.pending {
+		task.fail(err)
+		delete(b.pending, id)
+		task.session.release()
+	}
+	b.Unlock()
+
+	for {
+		select {
+		case task := <-b.requestQueue:
+			task.fail(err)
+		default:
+			return
+		}
 	}
-	close(b.requestQueue)
 }
 
+// Send sends the request to the HSM and waits for the response for the
+// broker timeout.
 func (b *broker) Send(req []byte) ([]byte, error) {
-	var (
-		resp []byte
-		err  error
-	)
-	task := b.newTask(req)
+	return b.SendContext(context.Background(), req)
+}
 
-	b.requestQueue <- task
+// SendContext sends the request to the HSM and waits for the response until
+// the context is done. The broker timeout applies if the context has no
+// deadline. A task whose context is done while it is still queued is
+// dropped without being written to the HSM. An idempotent command that
+// fails after being written is retried on another HSM, if one is available;
+// otherwise the error of the failed attempt is returned.
+func (b *broker) SendContext(ctx context.Context, req []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	tried := make(map[*target]bool)
+	for attempt := 0; ; attempt++ {
+		resp, t, err := b.attempt(ctx, req, tried)
+		if err == nil || t == nil || ctx.Err() != nil || attempt >= b.retries || !retryable(req) || errors.Is(err, ErrShuttingDown) {
+			return resp, err
+		}
+		tried[t] = true
+		if !b.available(tried) {
+			// no other HSM to retry on
+			return resp, err
+		}
+		b.logger.Log("hsm", t.Name, "retry", commandCode(req), "err", err)
+		b.retried.With("hsm", t.Name, "command", commandCode(req)).Add(1)
+	}
+}
+
+// attempt sends the request once, to a target not in the excluded set. On
+// failure it returns the target the command was written to, if any.
+func (b *broker) attempt(ctx context.Context, req []byte, exclude map[*target]bool) ([]byte, *target, error) {
+	if !b.begin() {
+		return nil, nil, ErrShuttingDown
+	}
+	defer b.active.Done()
+
+	if b.attemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.attemptTimeout)
+		defer cancel()
+	}
+
+	task := b.newTask(ctx, req, exclude)
+	if err := b.enqueue(ctx, task); err != nil {
+		return nil, nil, err
+	}
 
 	select {
-	case resp = <-task.response:
-	case err = <-task.errCh:
+	case resp := <-task.response:
+		return resp, nil, nil
+	case err := <-task.errCh:
+		t := b.taskTarget(task)
 		b.failPending(task)
-		return nil, err
-	case <-time.After(b.timeout):
-		b.failPending(task)
-		return nil, ErrTimeout
+		return nil, t, err
+	case <-ctx.Done():
+		t := b.taskTarget(task)
+		if b.failPending(task) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// the HSM did not answer in time
+			b.targetFailed(t, ErrTimeout)
+			b.closeIfSilent(task)
+			return nil, t, ErrTimeout
+		}
+		return nil, nil, ctxErr(ctx)
+	}
+}
+
+// begin counts a task being sent unless the broker is shutting down.
+func (b *broker) begin() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.closing {
+		return false
+	}
+	b.active.Add(1)
+	return true
+}
+
+// shuttingDown reports whether Shutdown has been called.
+func (b *broker) shuttingDown() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.closing
+}
+
+// enqueue queues the task for the workers. It waits up to the max queue
+// wait for room in a full queue and fails with ErrOverloaded after that.
+func (b *broker) enqueue(ctx context.Context, task *Task) error {
+	select {
+	case b.requestQueue <- task:
+		b.queueDepth.Set(float64(len(b.requestQueue)))
+		return nil
+	default:
+	}
+
+	if b.maxQueueWait > 0 {
+		timer := time.NewTimer(b.maxQueueWait)
+		defer timer.Stop()
+		select {
+		case b.requestQueue <- task:
+			b.queueDepth.Set(float64(len(b.requestQueue)))
+			return nil
+		case <-ctx.Done():
+			return ctxErr(ctx)
+		case <-timer.C:
+		}
 	}
+	b.rejected.Add(1)
+	return ErrOverloaded
+}
 
-	return resp, nil
+// ctxErr returns ErrTimeout if the deadline of the context is exceeded and
+// the context error otherwise.
+func ctxErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
 }
 
-func (b *broker) newTask(r []byte) *Task {
-	return &Task{
-		taskID:   randString(taskIDSize),
+func (b *broker) newTask(ctx context.Context, r []byte, exclude map[*target]bool) *Task {
+	task := &Task{
+		ctx:      ctx,
 		request:  r,
-		response: make(chan []byte),
-		errCh:    make(chan error),
+		response: make(chan []byte, 1),
+		errCh:    make(chan error, 1),
+		exclude:  make(map[*target]bool, len(exclude)),
+	}
+	for t := range exclude {
+		task.exclude[t] = true
 	}
+	return task
 }
 
-func (b *broker) addTask(task *Task) []byte {
+// fail reports the error to the task unless it has already got a result.
+func (t *Task) fail(err error) {
+	select {
+	case t.errCh <- err:
+	default:
+	}
+}
+
+// addTask gives the task an ID unique among the pending tasks and adds it
+// to them.
+func (b *broker) addTask(task *Task, s *session) error {
 	b.Lock()
-	b.pending[task.taskID] = task
+	defer b.Unlock()
+	id, err := b.nextTaskID()
+	if err != nil {
+		return err
+	}
+	task.taskID = id
+	task.session = s
+	task.sent = time.Now()
+	b.pending[id] = task
+	return nil
+}
+
+// closeIfSilent closes the session of the timed out task if no response has
+// been read from it since the task was sent: either the HSM does not answer
+// on the connection or the stream is out of step after a bad frame, and the
+// tasks sent on it would time out too.
+func (b *broker) closeIfSilent(task *Task) {
+	b.Lock()
+	s, sent := task.session, task.sent
 	b.Unlock()
-	return append([]byte(task.taskID), task.request...)
+	if s == nil || !s.silentSince(sent) {
+		return
+	}
+	b.logger.Log("err", fmt.Sprintf("no response from %s since %s; connection closed", s.conn.RemoteAddr(), sent.Format(time.RFC3339Nano)))
+	s.close(ErrTimeout)
 }
 
+// taskTarget returns the target the task has been written to, or nil.
+func (b *broker) taskTarget(task *Task) *target {
+	b.Lock()
+	defer b.Unlock()
+	if task.session == nil {
+		return nil
+	}
+	return task.session.target
+}
+
+// worker writes the queued tasks to the HSM connections. It returns the
+// connection to the pool as soon as the request is written, the reader of
+// the session delivers the response.
 func (b *broker) worker(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-b.quit:
+			return nil
 		case task := <-b.requestQueue:
-			out, err := Encode(b.addTask(task))
-			if err != nil {
-				b.logger.Log("err", err)
-				task.errCh <- err
+			b.queueDepth.Set(float64(len(b.requestQueue)))
+			if err := task.ctx.Err(); err != nil {
+				b.logger.Log("info", fmt.Sprintf("task %s dropped: %v", commandCode(task.request), err))
 				continue
 			}
-			conn, err := b.connPool.GetWithContext(ctx)
-			if err != nil {
-				b.logger.Log("err", err)
-				task.errCh <- err
-				b.connPool.Release(conn)
-				continue
-			}
-			c := conn.(net.Conn)
+			b.dispatch(task)
+		}
 
-			n, err := c.Write(out)
-			if err != nil {
-				b.logger.Log("err", err)
-				task.errCh <- err
-				b.connPool.Release(conn)
-				continue
-			}
-			b.logger.Log("info", fmt.Sprintf("write %d bytes to %s", n, c.RemoteAddr()))
-			b.logger.Log("info", fmt.Sprintf("%s -> %s", c.RemoteAddr(), out))
-
-			resp, err := Decode(bufio.NewReader(c))
-			if err != nil {
-				b.logger.Log("err", err)
-				task.errCh <- err
-				b.connPool.Release(conn)
-				continue
-			}
-			b.logger.Log("info", fmt.Sprintf("read from %s", c.RemoteAddr()))
-			b.logger.Log("info", fmt.Sprintf("%s <- %s", c.RemoteAddr(), resp))
-			b.respondPending(resp)
-			b.connPool.Put(conn)
+	}
+}
+
+// dispatch sends the task to an HSM selected by the strategy. A task that
+// could not be written to an HSM is tried on the next one.
+func (b *broker) dispatch(task *Task) {
+	tried := task.exclude
+	var lastErr error = ErrNoTarget
+	for {
+		t := b.pick(tried)
+		if t == nil {
+			task.fail(lastErr)
+			return
+		}
+		tried[t] = true
+
+		retry, err := b.send(task, t)
+		if err == nil {
+			return
+		}
+		if task.ctx.Err() != nil {
+			b.logger.Log("info", fmt.Sprintf("task %s dropped: %v", commandCode(task.request), task.ctx.Err()))
+			return
 		}
+		b.logger.Log("hsm", t.Name, "err", err)
+		if !retry {
+			task.fail(err)
+			return
+		}
+		lastErr = err
+	}
+}
+
+// send writes the task to a connection of the target. It reports whether
+// the task may be sent to another target, i.e. nothing has been written.
+func (b *broker) send(task *Task, t *target) (bool, error) {
+	conn, s, err := b.getSession(task.ctx, t)
+	if err != nil {
+		if errors.Is(err, pool.ErrClosing) && b.shuttingDown() {
+			// the pools are closed by Shutdown, not failing
+			return false, ErrShuttingDown
+		}
+		if task.ctx.Err() == nil {
+			b.targetFailed(t, err)
+		}
+		return true, err
+	}
+
+	retry, err := b.write(task, t, conn, s)
+	if err != nil {
+		return retry, err
+	}
+	t.Pool.Put(conn)
+	return false, nil
+}
+
+// write writes the task to the session of the borrowed connection. The
+// caller gets the connection back on success, it is returned to the pool or
+// released on failure. It reports whether the task may be sent to another
+// target.
+func (b *broker) write(task *Task, t *target, conn net.Conn, s *session) (bool, error) {
+	// wait for a free slot on the connection
+	select {
+	case s.slots <- struct{}{}:
+		atomic.AddInt64(&t.pending, 1)
+	case <-s.done:
+		b.releaseSession(t, conn)
+		return true, s.Err()
+	case <-task.ctx.Done():
+		t.Pool.Put(conn)
+		return false, task.ctx.Err()
+	}
+
+	if err := b.addTask(task, s); err != nil {
+		s.release()
+		t.Pool.Put(conn)
+		return false, err
+	}
+	out, err := b.framer.Frame(append([]byte(task.taskID), task.request...))
+	if err != nil {
+		b.failPending(task)
+		t.Pool.Put(conn)
+		return false, err
+	}
+
+	if deadline, ok := task.ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	n, err := s.conn.Write(out)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ErrTimeout
+		}
+		b.failPending(task)
+		s.close(err)
+		b.releaseSession(t, conn)
+		b.targetFailed(t, err)
+		return false, err
+	}
+	s.conn.SetWriteDeadline(time.Time{})
+	b.logger.Log("info", fmt.Sprintf("write %d bytes to %s", n, s.conn.RemoteAddr()))
+	b.logger.Log("info", fmt.Sprintf("%s -> %s", s.conn.RemoteAddr(), out))
+	return false, nil
+}
 
+// getSession borrows a connection from the pool and returns its session,
+// starting the reader of a new connection. Closed connections and those
+// whose session has failed are released from the pool.
+func (b *broker) getSession(ctx context.Context, t *target) (net.Conn, *session, error) {
+	for {
+		conn, err := t.Pool.GetWithContext(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s := b.session(t, conn); s != nil {
+			return conn, s, nil
+		}
 	}
 }
 
-func (b *broker) respondPending(msg []byte) {
+// session returns the session of the borrowed connection, starting the
+// reader of a new connection. It releases a closed or failed connection
+// and returns nil.
+func (b *broker) session(t *target, conn net.Conn) *session {
+	b.Lock()
+	s, ok := b.sessions[conn]
+	b.Unlock()
+	if !ok {
+		// the session of a failed connection is gone with its reader
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			t.Pool.Release(conn)
+			return nil
+		}
+		s = newSession(conn, b.framer, b.maxInFlight, t)
+		b.Lock()
+		b.sessions[conn] = s
+		b.Unlock()
+		go b.reader(s)
+	}
+
+	select {
+	case <-s.done:
+		b.releaseSession(t, conn)
+		return nil
+	default:
+	}
+	return s
+}
+
+// releaseSession closes the connection and removes it from the pool.
+func (b *broker) releaseSession(t *target, conn net.Conn) {
+	b.Lock()
+	delete(b.sessions, conn)
+	b.Unlock()
+	t.Pool.Release(conn)
+}
+
+// reader reads the responses of the session until the connection fails or
+// is closed, e.g. when the pool evicts it, then fails the tasks still in
+// flight on it. A connection failing with tasks in flight counts as a
+// failure of its HSM.
+func (b *broker) reader(s *session) {
+	err := s.read(func(resp []byte) {
+		b.logger.Log("info", fmt.Sprintf("read from %s", s.conn.RemoteAddr()))
+		b.logger.Log("info", fmt.Sprintf("%s <- %s", s.conn.RemoteAddr(), resp))
+		b.respondPending(s, resp)
+	})
+	// the error the session was closed with, e.g. ErrShuttingDown
+	err = s.Err()
+	b.logger.Log("err", fmt.Sprintf("connection to %s failed: %v", s.conn.RemoteAddr(), err))
+
+	inFlight := false
+	b.Lock()
+	if b.sessions[s.conn] == s {
+		delete(b.sessions, s.conn)
+	}
+	for id, task := range b.pending {
+		if task.session == s {
+			task.fail(err)
+			delete(b.pending, id)
+			s.release()
+			inFlight = true
+		}
+	}
+	b.Unlock()
+	if inFlight && !errors.Is(err, ErrShuttingDown) {
+		b.targetFailed(s.target, err)
+	}
+}
+
+// respondPending delivers the response read from the session to its pending
+// task. A response is discarded unless the task is in flight on the session
+// and the response code answers its command.
+func (b *broker) respondPending(s *session, msg []byte) {
 	var (
 		task *Task
 		ok   bool
 	)
-	header := string((msg)[:taskIDSize])
-	response := (msg)[taskIDSize:]
+	if len(msg) < b.headerLength {
+		b.logger.Log("info", fmt.Sprintf("response %q is shorter than the header; response descarded", msg))
+		return
+	}
+	header := string((msg)[:b.headerLength])
+	response := (msg)[b.headerLength:]
 	b.Lock()
-	defer b.Unlock()
-	if task, ok = b.pending[header]; !ok {
+	if task, ok = b.pending[header]; !ok || task.session != s {
+		b.Unlock()
 		b.logger.Log("info", fmt.Sprintf("pending task for %s not found; response descarded", header))
 		return
 	}
+	if code := commandCode(response); code != thales.ResponseCode(commandCode(task.request)) {
+		b.Unlock()
+		b.logger.Log("info", fmt.Sprintf("response %q to %s does not answer %s; response descarded", code, header, commandCode(task.request)))
+		return
+	}
 	task.response <- response
 	delete(b.pending, header)
+	task.session.release()
+	b.Unlock()
+	b.targetSucceeded(task.session.target)
 }
 
-func (b *broker) failPending(task *Task) {
+// failPending removes the task from the pending list and reports whether it
+// was in flight. A task answered or failed in the meantime is gone, and its
+// ID may already be held by another task.
+func (b *broker) failPending(task *Task) bool {
 	b.Lock()
 	defer b.Unlock()
-	defer close(task.response)
-	defer close(task.errCh)
-	delete(b.pending, task.taskID)
+	if b.pending[task.taskID] == task {
+		delete(b.pending, task.taskID)
+		task.session.release()
+		return true
+	}
+	return false
 }
@@ -0,0 +1,518 @@
+//go:build !production
+
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/hsmsim"
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/log"
+)
+
+// newServer returns a simulator server injecting the faults.
+func newServer(t *testing.T, faults ...hsmsim.Fault) *hsmsim.Server {
+	t.Helper()
+	sim, err := hsmsim.New(hsmsim.DefaultLMK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &hsmsim.Server{Simulator: sim, Scenario: &hsmsim.Scenario{Faults: faults, Seed: 1}}
+}
+
+// startBroker starts the broker and shuts it down at the end of the test.
+func startBroker(t *testing.T, b interface {
+	Start(context.Context)
+	Close()
+}) {
+	t.Helper()
+	started := make(chan struct{})
+	go func() {
+		b.Start(context.Background())
+		close(started)
+	}()
+	t.Cleanup(func() {
+		b.Close()
+		<-started
+	})
+}
+
+func TestRetrySingleTarget(t *testing.T) {
+	srv := newServer(t, hsmsim.Fault{Kind: hsmsim.FaultDrop})
+	b := broker.NewBroker(pool.NewPool(1, srv.Dial), 1, log.NewNopLogger(),
+		broker.WithTimeout(time.Second),
+		broker.WithAttemptTimeout(50*time.Millisecond),
+		broker.WithRetries(1),
+	)
+	startBroker(t, b)
+
+	if _, err := b.Send([]byte("B20004echo")); !errors.Is(err, broker.ErrTimeout) {
+		t.Errorf("got %v, want %v", err, broker.ErrTimeout)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		command string
+		// retried expects the command on the second HSM
+		retried bool
+	}{
+		{"idempotent", "DC", true},
+		{"key generation", "A0", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var a, b int64
+			// the first HSM does not answer
+			hsmA, hsmB := countingServer(t, &a, hsmsim.Fault{Kind: hsmsim.FaultDrop}), countingServer(t, &b)
+			retried, changes := &counter{}, &counter{}
+			br := broker.NewMultiBroker([]broker.Target{
+				{Name: "a", Pool: pool.NewPool(1, hsmA.Dial)},
+				{Name: "b", Pool: pool.NewPool(1, hsmB.Dial)},
+			}, 1, log.NewNopLogger(),
+				broker.WithStrategy(broker.PrimaryStandby),
+				broker.WithTimeout(time.Second),
+				broker.WithAttemptTimeout(50*time.Millisecond),
+				broker.WithRetries(1),
+				broker.WithRetryMetrics(retried),
+				broker.WithFailureThreshold(1),
+				broker.WithBreakerMetrics(changes, discard.NewGauge()),
+			)
+			startBroker(t, br)
+
+			resp, err := br.Send([]byte(tc.command + "0000"))
+			if tc.retried && (err != nil || len(resp) < 2 || string(resp[:2]) != "DD") {
+				t.Errorf("got %q, %v, want the response of the second HSM", resp, err)
+			}
+			if !tc.retried && !errors.Is(err, broker.ErrTimeout) {
+				t.Errorf("got %q, %v, want %v", resp, err, broker.ErrTimeout)
+			}
+
+			wantB, wantRetries := int64(0), 0.0
+			if tc.retried {
+				wantB, wantRetries = 1, 1
+			}
+			if a, b := atomic.LoadInt64(&a), atomic.LoadInt64(&b); a != 1 || b != wantB {
+				t.Errorf("a got %d commands, b got %d, want 1 and %d", a, b, wantB)
+			}
+			if n := retried.Value(); n != wantRetries {
+				t.Errorf("%v retries counted, want %v", n, wantRetries)
+			}
+			// the timeout opens the breaker of the first HSM
+			if n := changes.Value(); n != 1 {
+				t.Errorf("%v breaker changes counted, want 1", n)
+			}
+			if s := br.Status()[0].Breaker; s != broker.Open.String() {
+				t.Errorf("breaker of a is %s, want %s", s, broker.Open)
+			}
+		})
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	srv := newServer(t, hsmsim.Fault{Kind: hsmsim.FaultLatency, Latency: hsmsim.Duration(100 * time.Millisecond)})
+	b := broker.NewBroker(pool.NewPool(1, srv.Dial), 8, log.NewNopLogger(),
+		broker.WithMaxInFlight(4),
+		broker.WithQueueSize(16),
+	)
+	startBroker(t, b)
+
+	var (
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+		max     int64
+	)
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := b.Status()[0].Pending; n > max {
+				max = n
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := b.Send([]byte("B20004echo")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(done)
+	<-stopped
+
+	if max != 4 {
+		t.Errorf("%d commands in flight at most, want 4", max)
+	}
+	// two rounds of 4 pipelined commands on the single connection
+	if elapsed < 200*time.Millisecond || elapsed >= 400*time.Millisecond {
+		t.Errorf("8 commands took %v, want 2 rounds of 100ms", elapsed)
+	}
+}
+
+// writeCounter is an HSM connection counting the writes, the HSM reads the
+// commands and never answers.
+type writeCounter struct {
+	net.Conn
+	writes int64
+}
+
+func newWriteCounter(t *testing.T) *writeCounter {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go io.Copy(io.Discard, server)
+	return &writeCounter{Conn: client}
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func TestSlotWaitCanceled(t *testing.T) {
+	conn := newWriteCounter(t)
+	b := broker.NewBroker(pool.NewPool(1, func(context.Context) (net.Conn, error) {
+		return conn, nil
+	}), 2, log.NewNopLogger(), broker.WithMaxInFlight(1))
+	startBroker(t, b)
+
+	// the first command takes the only slot of the connection
+	first, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	go b.SendContext(first, []byte("B20004echo"))
+	for atomic.LoadInt64(&conn.writes) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := b.SendContext(ctx, []byte("B20004echo"))
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, broker.ErrTimeout) {
+		t.Errorf("got %v, want context.Canceled or ErrTimeout", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&conn.writes); n != 1 {
+		t.Errorf("%d commands written, want the first one only", n)
+	}
+}
+
+// countingServer returns a simulator server counting the commands it
+// answers.
+func countingServer(t *testing.T, n *int64, faults ...hsmsim.Fault) *hsmsim.Server {
+	t.Helper()
+	srv := newServer(t, faults...)
+	srv.Logger = log.LoggerFunc(func(keyvals ...interface{}) error {
+		for i := 0; i < len(keyvals); i += 2 {
+			if keyvals[i] == "command" {
+				atomic.AddInt64(n, 1)
+			}
+		}
+		return nil
+	})
+	return srv
+}
+
+func TestStrategies(t *testing.T) {
+	slow := hsmsim.Fault{Kind: hsmsim.FaultLatency, Latency: hsmsim.Duration(20 * time.Millisecond)}
+	for _, tc := range []struct {
+		name     string
+		strategy broker.Strategy
+		weights  [2]int
+		// slow delays the replies of the first HSM
+		slow  bool
+		check func(a, b int64) bool
+	}{
+		{"round-robin", broker.RoundRobin, [2]int{3, 1}, false, func(a, b int64) bool { return a == 30 && b == 10 }},
+		{"round-robin unweighted", broker.RoundRobin, [2]int{0, 0}, false, func(a, b int64) bool { return a == 20 && b == 20 }},
+		{"primary-standby", broker.PrimaryStandby, [2]int{1, 1}, false, func(a, b int64) bool { return a == 40 && b == 0 }},
+		{"least-pending", broker.LeastPending, [2]int{1, 1}, true, func(a, b int64) bool { return b > 2*a }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var a, b int64
+			var faults []hsmsim.Fault
+			if tc.slow {
+				faults = append(faults, slow)
+			}
+			hsmA, hsmB := countingServer(t, &a, faults...), countingServer(t, &b)
+			br := broker.NewMultiBroker([]broker.Target{
+				{Name: "a", Pool: pool.NewPool(1, hsmA.Dial), Weight: tc.weights[0]},
+				{Name: "b", Pool: pool.NewPool(1, hsmB.Dial), Weight: tc.weights[1]},
+			}, 4, log.NewNopLogger(),
+				broker.WithStrategy(tc.strategy),
+				broker.WithMaxInFlight(4),
+			)
+			startBroker(t, br)
+
+			// 4 callers send 10 commands each
+			var wg sync.WaitGroup
+			for c := 0; c < 4; c++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 10; i++ {
+						if _, err := br.Send([]byte("B20004echo")); err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			a, b = atomic.LoadInt64(&a), atomic.LoadInt64(&b)
+			if !tc.check(a, b) {
+				t.Errorf("a got %d commands, b got %d", a, b)
+			}
+		})
+	}
+}
+
+// counter is a metrics.Counter summing what is added to it.
+type counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *counter) With(...string) metrics.Counter { return c }
+
+func (c *counter) Add(delta float64) {
+	c.mu.Lock()
+	c.value += delta
+	c.mu.Unlock()
+}
+
+func (c *counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+func TestFailover(t *testing.T) {
+	var a, b int64
+	hsmA, hsmB := countingServer(t, &a), countingServer(t, &b)
+	var down int32 = 1
+	dialA := func(ctx context.Context) (net.Conn, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return hsmA.Dial(ctx)
+	}
+	br := broker.NewMultiBroker([]broker.Target{
+		{Name: "a", Pool: pool.NewPool(1, dialA, pool.WithDialBackoff[net.Conn](time.Millisecond, time.Millisecond))},
+		{Name: "b", Pool: pool.NewPool(1, hsmB.Dial)},
+	}, 1, log.NewNopLogger(),
+		broker.WithFailureThreshold(3),
+		broker.WithRecoveryInterval(100*time.Millisecond),
+	)
+	startBroker(t, br)
+
+	send := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := br.Send([]byte("B20004echo")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the commands go to b while a is down, until a is taken out of
+	// rotation after 3 failures
+	send(10)
+	if s := br.Status()[0].Breaker; s != broker.Open.String() {
+		t.Fatalf("breaker of a is %s, want %s", s, broker.Open)
+	}
+	if a, b := atomic.LoadInt64(&a), atomic.LoadInt64(&b); a != 0 || b != 10 {
+		t.Fatalf("a got %d commands, b got %d, want 0 and 10", a, b)
+	}
+
+	// a comes back after the recovery interval
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(150 * time.Millisecond)
+	send(10)
+	if s := br.Status()[0].Breaker; s != broker.Closed.String() {
+		t.Fatalf("breaker of a is %s, want %s", s, broker.Closed)
+	}
+	if a := atomic.LoadInt64(&a); a < 4 {
+		t.Errorf("a got %d of 10 commands after it recovered", a)
+	}
+}
+
+func TestOverloaded(t *testing.T) {
+	srv := newServer(t, hsmsim.Fault{Kind: hsmsim.FaultLatency, Latency: hsmsim.Duration(200 * time.Millisecond)})
+	rejected := &counter{}
+	// the worker waits for the single slot of the connection with the
+	// second command, the third one is queued
+	b := broker.NewBroker(pool.NewPool(1, srv.Dial), 1, log.NewNopLogger(),
+		broker.WithQueueSize(1),
+		broker.WithQueueMetrics(discard.NewGauge(), rejected),
+	)
+	startBroker(t, b)
+
+	var (
+		wg         sync.WaitGroup
+		ok, failed int64
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Send([]byte("B20004echo"))
+			switch {
+			case err == nil:
+				atomic.AddInt64(&ok, 1)
+			case errors.Is(err, broker.ErrOverloaded):
+				atomic.AddInt64(&failed, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if ok < 1 || ok > 3 || failed != 8-ok {
+		t.Errorf("%d commands answered, %d rejected", ok, failed)
+	}
+	if n := int64(rejected.Value()); n != failed {
+		t.Errorf("%d rejections counted, want %d", n, failed)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	srv := newServer(t)
+	p := pool.NewPool(1, srv.Dial, pool.WithMinIdle[net.Conn](1))
+	b := broker.NewBroker(p, 1, log.NewNopLogger(), broker.WithKeepalive(20*time.Millisecond))
+	startBroker(t, b)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Status()[0].CheckedAt.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("no keepalive probe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	status := b.Status()[0]
+	if status.Firmware != hsmsim.DefaultFirmware || len(status.LMKCheckValue) != 16 {
+		t.Errorf("got firmware %q, LMK check value %q, want firmware %s", status.Firmware, status.LMKCheckValue, hsmsim.DefaultFirmware)
+	}
+	// the probed connection is kept
+	if stats := p.Stats(); stats.Created != 1 || stats.Destroyed != 0 {
+		t.Errorf("got %+v, want the connection kept", stats)
+	}
+}
+
+func TestKeepaliveFailed(t *testing.T) {
+	srv := newServer(t, hsmsim.Fault{Kind: hsmsim.FaultTruncate, Command: "NC", Length: 6})
+	p := pool.NewPool(1, srv.Dial, pool.WithMinIdle[net.Conn](1))
+	b := broker.NewBroker(p, 1, log.NewNopLogger(), broker.WithKeepalive(20*time.Millisecond))
+	startBroker(t, b)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().Destroyed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection failing the probe was not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := b.Status()[0]; !status.CheckedAt.IsZero() || status.Firmware != "" {
+		t.Errorf("got %+v after a failed probe", status)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		grace time.Duration
+		// wantErr is the error of the commands in flight
+		wantErr error
+	}{
+		{"in-flight commands finish", time.Second, nil},
+		{"grace period runs out", 50 * time.Millisecond, broker.ErrShuttingDown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t, hsmsim.Fault{Kind: hsmsim.FaultLatency, Latency: hsmsim.Duration(200 * time.Millisecond)})
+			b := broker.NewBroker(pool.NewPool(1, srv.Dial), 4, log.NewNopLogger(),
+				broker.WithMaxInFlight(4),
+			)
+			startBroker(t, b)
+
+			errs := make(chan error, 4)
+			for i := 0; i < 4; i++ {
+				go func() {
+					_, err := b.Send([]byte("B20004echo"))
+					errs <- err
+				}()
+			}
+			for b.Status()[0].Pending < 4 {
+				time.Sleep(time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.grace)
+			defer cancel()
+			if err := b.Shutdown(ctx); (err != nil) != (tc.wantErr != nil) {
+				t.Errorf("Shutdown: got %v", err)
+			}
+			if _, err := b.Send([]byte("B20004echo")); !errors.Is(err, broker.ErrShuttingDown) {
+				t.Errorf("command after the shutdown: got %v, want %v", err, broker.ErrShuttingDown)
+			}
+			for i := 0; i < 4; i++ {
+				if err := <-errs; !errors.Is(err, tc.wantErr) {
+					t.Errorf("command in flight: got %v, want %v", err, tc.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderWraparound(t *testing.T) {
+	srv := newServer(t)
+	srv.HeaderLength = 1
+	b := broker.NewBroker(pool.NewPool(1, srv.Dial), 4, log.NewNopLogger(),
+		broker.WithHeaderLength(1),
+		broker.WithMaxInFlight(8),
+	)
+	startBroker(t, b)
+
+	// 4 callers go through the 36 IDs of the header more than twice
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				data := fmt.Sprintf("C%dN%02d", c, i)
+				resp, err := b.Send([]byte(fmt.Sprintf("B2%04X%s", len(data), data)))
+				if err != nil || string(resp) != "B300"+data {
+					t.Errorf("%s: got %q, %v", data, resp, err)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+}
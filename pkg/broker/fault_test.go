@@ -0,0 +1,201 @@
+//go:build !production
+
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/hsmsim"
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+)
+
+// logRecorder counts the log lines containing each of the messages.
+type logRecorder struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (l *logRecorder) Log(keyvals ...interface{}) error {
+	line := fmt.Sprint(keyvals...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for msg := range l.counts {
+		if strings.Contains(line, msg) {
+			l.counts[msg]++
+		}
+	}
+	return nil
+}
+
+func (l *logRecorder) count(msg string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[msg]
+}
+
+const unmatched = "not found; response descarded"
+
+// checkGoroutines fails the test if the goroutines started since base are
+// still running after a grace period.
+func checkGoroutines(t *testing.T, base int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("%d goroutines running, %d before:\n%s", runtime.NumGoroutine(), base, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faults []hsmsim.Fault
+		// allOK expects every command to succeed
+		allOK bool
+		// wantUnmatched expects responses without a pending task
+		wantUnmatched bool
+	}{
+		{name: "none", allOK: true},
+		{
+			name:   "latency",
+			faults: []hsmsim.Fault{{Kind: hsmsim.FaultLatency, Rate: 0.3, Latency: hsmsim.Duration(20 * time.Millisecond)}},
+			allOK:  true,
+		},
+		{
+			name:          "latency past the timeout",
+			faults:        []hsmsim.Fault{{Kind: hsmsim.FaultLatency, Rate: 0.1, Latency: hsmsim.Duration(300 * time.Millisecond)}},
+			wantUnmatched: true,
+		},
+		{name: "dropped replies", faults: []hsmsim.Fault{{Kind: hsmsim.FaultDrop, Rate: 0.1}}},
+		{name: "truncated frames", faults: []hsmsim.Fault{{Kind: hsmsim.FaultTruncate, Rate: 0.1}}},
+		{name: "truncated headers", faults: []hsmsim.Fault{{Kind: hsmsim.FaultTruncate, Rate: 0.1, Length: 2}}},
+		{
+			name:          "wrong headers",
+			faults:        []hsmsim.Fault{{Kind: hsmsim.FaultWrongHeader, Rate: 0.1}},
+			wantUnmatched: true,
+		},
+		{name: "garbage bytes", faults: []hsmsim.Fault{{Kind: hsmsim.FaultGarbage, Rate: 0.05}}},
+		{name: "disconnects", faults: []hsmsim.Fault{{Kind: hsmsim.FaultDisconnect, Rate: 0.05}}},
+		{
+			name: "all of them",
+			faults: []hsmsim.Fault{
+				{Kind: hsmsim.FaultLatency, Rate: 0.1, Latency: hsmsim.Duration(300 * time.Millisecond)},
+				{Kind: hsmsim.FaultDrop, Rate: 0.05},
+				{Kind: hsmsim.FaultTruncate, Rate: 0.05},
+				{Kind: hsmsim.FaultWrongHeader, Rate: 0.05},
+				{Kind: hsmsim.FaultGarbage, Rate: 0.02},
+				{Kind: hsmsim.FaultDisconnect, Rate: 0.02},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base := runtime.NumGoroutine()
+			truncates := false
+			for _, f := range tc.faults {
+				truncates = truncates || f.Kind == hsmsim.FaultTruncate
+			}
+
+			sim, err := hsmsim.New(hsmsim.DefaultLMK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &hsmsim.Server{Simulator: sim, Scenario: &hsmsim.Scenario{Faults: tc.faults, Seed: 1}}
+			logs := &logRecorder{counts: map[string]int{unmatched: 0}}
+			b := broker.NewBroker(pool.NewPool(2, srv.Dial), 4, logs,
+				broker.WithTimeout(200*time.Millisecond),
+				broker.WithRetries(0),
+				broker.WithMaxInFlight(8),
+				broker.WithQueueSize(256),
+			)
+			started := make(chan struct{})
+			go func() {
+				b.Start(context.Background())
+				close(started)
+			}()
+
+			const callers, commands = 16, 25
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				ok, fail int
+			)
+			for c := 0; c < callers; c++ {
+				wg.Add(1)
+				go func(c int) {
+					defer wg.Done()
+					for i := 0; i < commands; i++ {
+						// the ID leads the data so that a reply truncated to
+						// half its length still holds it
+						id := fmt.Sprintf("C%02dN%02d", c, i)
+						data := id + " echoed by the hsm"
+						want := "B300" + data
+						resp, err := b.Send([]byte(fmt.Sprintf("B2%04X%s", len(data), data)))
+
+						mu.Lock()
+						if err == nil && string(resp) == want {
+							ok++
+						} else {
+							fail++
+						}
+						mu.Unlock()
+
+						// a reply is the full echo, or a truncated one that
+						// still holds the ID of the caller's command
+						if err == nil && string(resp) != want &&
+							!(truncates && strings.HasPrefix(string(resp), "B300"+id) && strings.HasPrefix(want, string(resp))) {
+							t.Errorf("%s: got %q", want, resp)
+						}
+						if err != nil && !isConnError(err) {
+							t.Errorf("%s: unexpected error %v", want, err)
+						}
+					}
+				}(c)
+			}
+			wg.Wait()
+
+			if tc.allOK && fail > 0 {
+				t.Errorf("%d of %d commands failed", fail, ok+fail)
+			}
+			if ok == 0 {
+				t.Errorf("no command succeeded")
+			}
+			// the late replies may come after the last command failed
+			for deadline := time.Now().Add(time.Second); tc.wantUnmatched && logs.count(unmatched) == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if tc.wantUnmatched && logs.count(unmatched) == 0 {
+				t.Errorf("no unmatched response was logged")
+			}
+			t.Logf("%d ok, %d failed, %d unmatched", ok, fail, logs.count(unmatched))
+
+			b.Close()
+			<-started
+			checkGoroutines(t, base)
+		})
+	}
+}
+
+// isConnError reports whether the error is a timeout or a failure of the
+// connection the command was in flight on.
+func isConnError(err error) bool {
+	return errors.Is(err, broker.ErrTimeout) ||
+		errors.Is(err, broker.ErrNoTarget) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed)
+}
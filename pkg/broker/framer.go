@@ -0,0 +1,220 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var (
+	ErrInvalidLRC    = errors.New("invalid LRC")
+	ErrInvalidFrame  = errors.New("invalid frame")
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// DefaultMaxFrameSize is the largest message a length prefixed or STX/ETX
+// framer reads by default.
+const DefaultMaxFrameSize = 64 << 10
+
+// maxFrameSize returns the size, or DefaultMaxFrameSize if zero.
+func maxFrameSize(size int) int {
+	if size > 0 {
+		return size
+	}
+	return DefaultMaxFrameSize
+}
+
+// Framer delimits the messages on an HSM connection.
+type Framer interface {
+	// Frame returns the message as written to the connection.
+	Frame(msg []byte) ([]byte, error)
+	// ReadFrame reads the next message. The reader lives as long as the
+	// connection, so bytes read past the message are kept for the next one.
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+}
+
+var (
+	// TwoByteLength prefixes the messages with their length as 2 bytes big
+	// endian, the payShield default.
+	TwoByteLength Framer = LengthPrefixed{Size: 2}
+	// FourByteLength prefixes the messages with their length as 4 bytes
+	// big endian.
+	FourByteLength Framer = LengthPrefixed{Size: 4}
+)
+
+var framers = map[string]Framer{
+	"2-byte":  TwoByteLength,
+	"4-byte":  FourByteLength,
+	"stx-etx": STXETX{},
+	"none":    Unframed{},
+}
+
+// ParseFramer returns the framer of the name: 2-byte, 4-byte, stx-etx or
+// none.
+func ParseFramer(name string) (Framer, error) {
+	f, ok := framers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown framing %q", name)
+	}
+	return f, nil
+}
+
+// LengthPrefixed prefixes the messages with their length as Size bytes big
+// endian. Size is 2 or 4. A message read longer than MaxSize, or than
+// DefaultMaxFrameSize if zero, fails with ErrFrameTooLarge before it is
+// read, which ends the session of the connection.
+type LengthPrefixed struct {
+	Size    int
+	MaxSize int
+}
+
+func (f LengthPrefixed) max() uint64 {
+	if f.Size == 2 {
+		return math.MaxUint16
+	}
+	return math.MaxUint32
+}
+
+func (f LengthPrefixed) Frame(msg []byte) ([]byte, error) {
+	if uint64(len(msg)) > f.max() {
+		return nil, ErrInvalidMsgLength
+	}
+	out := make([]byte, f.Size, f.Size+len(msg))
+	if f.Size == 2 {
+		binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	} else {
+		binary.BigEndian.PutUint32(out, uint32(len(msg)))
+	}
+	return append(out, msg...), nil
+}
+
+func (f LengthPrefixed) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	prefix := make([]byte, f.Size)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	var length uint64
+	if f.Size == 2 {
+		length = uint64(binary.BigEndian.Uint16(prefix))
+	} else {
+		length = uint64(binary.BigEndian.Uint32(prefix))
+	}
+	maxSize := uint64(maxFrameSize(f.MaxSize))
+	if length > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrFrameTooLarge, length, maxSize)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+const (
+	stx = 0x02
+	etx = 0x03
+)
+
+// STXETX encloses the messages in STX and ETX followed by the LRC, the XOR
+// of the bytes after STX up to and including ETX. Bytes before STX are
+// skipped. A message read longer than MaxSize, or than DefaultMaxFrameSize if
+// zero, fails with ErrFrameTooLarge once that many bytes came without ETX,
+// which ends the session of the connection.
+type STXETX struct {
+	MaxSize int
+}
+
+func (STXETX) Frame(msg []byte) ([]byte, error) {
+	if bytes.IndexByte(msg, stx) >= 0 || bytes.IndexByte(msg, etx) >= 0 {
+		return nil, fmt.Errorf("%w: message holds STX or ETX", ErrInvalidFrame)
+	}
+	out := make([]byte, 0, len(msg)+3)
+	out = append(out, stx)
+	out = append(out, msg...)
+	out = append(out, etx)
+	return append(out, lrc(out[1:])), nil
+}
+
+func (f STXETX) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	// skip the bytes before STX
+	for {
+		_, err := r.ReadSlice(stx)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	// read up to ETX, at most MaxSize bytes before it
+	maxSize := maxFrameSize(f.MaxSize)
+	var body []byte
+	for {
+		chunk, err := r.ReadSlice(etx)
+		if len(body)+len(chunk) > maxSize+1 {
+			return nil, fmt.Errorf("%w: no ETX in %d bytes", ErrFrameTooLarge, maxSize)
+		}
+		body = append(body, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, noEOF(err)
+		}
+	}
+	check, err := r.ReadByte()
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	if lrc(body) != check {
+		return nil, ErrInvalidLRC
+	}
+	return body[:len(body)-1], nil
+}
+
+// lrc returns the XOR of the bytes.
+func lrc(b []byte) byte {
+	var x byte
+	for _, c := range b {
+		x ^= c
+	}
+	return x
+}
+
+// noEOF turns EOF within a frame into ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Unframed writes the messages as they are. A message is what the
+// connection delivers at once, which holds on a local network for messages
+// written one at a time but not in general: a response split across TCP
+// segments is read as two messages, the second without its header, and
+// responses arriving together are read as one. It is only meant for HSMs
+// that can't frame their messages, with a single command in flight per
+// connection (WithMaxInFlight(1)).
+type Unframed struct{}
+
+func (Unframed) Frame(msg []byte) ([]byte, error) {
+	return msg, nil
+}
+
+func (Unframed) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	// wait for the first byte, then take what has arrived with it
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, r.Buffered())
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFramers(t *testing.T) {
+	messages := [][]byte{
+		[]byte("0000NC"),
+		[]byte("0001DC" + string(bytes.Repeat([]byte("A"), 300))),
+		[]byte(""),
+		bytes.Repeat([]byte("B"), 40000),
+	}
+
+	for name, f := range map[string]Framer{
+		"2-byte":  TwoByteLength,
+		"4-byte":  FourByteLength,
+		"stx-etx": STXETX{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var stream []byte
+			for _, msg := range messages {
+				out, err := f.Frame(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stream = append(stream, out...)
+			}
+
+			// fragmented reads deliver one byte at a time
+			r := bufio.NewReader(iotest.OneByteReader(bytes.NewReader(stream)))
+			for i, want := range messages {
+				got, err := f.ReadFrame(r)
+				if err != nil {
+					t.Fatalf("message %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("message %d: got %d bytes, want %d", i, len(got), len(want))
+				}
+			}
+			if _, err := f.ReadFrame(r); err != io.EOF {
+				t.Errorf("after the last message: got %v, want EOF", err)
+			}
+
+			// a truncated frame
+			r = bufio.NewReader(bytes.NewReader(stream[:len(stream)-1]))
+			for range messages[:len(messages)-1] {
+				if _, err := f.ReadFrame(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := f.ReadFrame(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("truncated frame: got %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	// the prefix of a 2 GiB message
+	stream := []byte{0x80, 0, 0, 0}
+	if _, err := FourByteLength.ReadFrame(bufio.NewReader(bytes.NewReader(stream))); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("4-byte: got %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	f := LengthPrefixed{Size: 2, MaxSize: 16}
+	out, err := f.Frame(make([]byte, 17))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadFrame(bufio.NewReader(bytes.NewReader(out))); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("2-byte: got %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	// the session of the connection ends
+	client, server := net.Pipe()
+	defer server.Close()
+	s := newSession(client, FourByteLength, 1, &target{})
+	go server.Write(stream)
+	if err := s.read(func([]byte) { t.Error("frame delivered") }); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("session: got %v, want %v", err, ErrFrameTooLarge)
+	}
+	if !errors.Is(s.Err(), ErrFrameTooLarge) {
+		t.Errorf("session ended with %v, want %v", s.Err(), ErrFrameTooLarge)
+	}
+}
+
+func TestTwoByteLengthTooLong(t *testing.T) {
+	if _, err := Encode(make([]byte, 1<<16)); !errors.Is(err, ErrInvalidMsgLength) {
+		t.Errorf("got %v, want %v", err, ErrInvalidMsgLength)
+	}
+}
+
+func TestSTXETX(t *testing.T) {
+	frame, err := STXETX{}.Frame([]byte("0000NC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// garbage before STX is skipped
+	r := bufio.NewReader(bytes.NewReader(append([]byte("noise"), frame...)))
+	if msg, err := (STXETX{}).ReadFrame(r); err != nil || string(msg) != "0000NC" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+
+	frame[len(frame)-1] ^= 0xFF
+	r = bufio.NewReader(bytes.NewReader(frame))
+	if _, err := (STXETX{}).ReadFrame(r); !errors.Is(err, ErrInvalidLRC) {
+		t.Errorf("got %v, want %v", err, ErrInvalidLRC)
+	}
+
+	if _, err := (STXETX{}).Frame([]byte{'A', etx}); !errors.Is(err, ErrInvalidFrame) {
+		t.Errorf("got %v, want %v", err, ErrInvalidFrame)
+	}
+}
+
+func TestSTXETXTooLarge(t *testing.T) {
+	f := STXETX{MaxSize: 16}
+	out, err := f.Frame(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := f.ReadFrame(bufio.NewReader(bytes.NewReader(out))); err != nil || len(msg) != 16 {
+		t.Errorf("16 bytes: got %d bytes, %v", len(msg), err)
+	}
+
+	out, err = f.Frame(make([]byte, 17))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ReadFrame(bufio.NewReader(bytes.NewReader(out))); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("17 bytes: got %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	// a stream without ETX is not buffered past the default size
+	stream := io.MultiReader(bytes.NewReader([]byte{stx}), zeros{})
+	if _, err := (STXETX{}).ReadFrame(bufio.NewReader(stream)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("no ETX: got %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestUnframed(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("0000ND00")))
+	if msg, err := (Unframed{}).ReadFrame(r); err != nil || string(msg) != "0000ND00" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+}
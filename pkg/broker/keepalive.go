@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+// Status is the state of an HSM target of the broker. The LMK check value
+// and the firmware number come from the last keepalive probe.
+type Status struct {
+	Name          string    `json:"name"`
+	Breaker       string    `json:"breaker"`
+	Pending       int64     `json:"pending"`
+	LMKCheckValue string    `json:"lmk_check_value,omitempty"`
+	Firmware      string    `json:"firmware,omitempty"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// Status returns the state of the HSM targets.
+func (b *broker) Status() []Status {
+	status := make([]Status, 0, len(b.targets))
+	for _, t := range b.targets {
+		t.infoMu.Lock()
+		info := t.info
+		t.infoMu.Unlock()
+
+		status = append(status, Status{
+			Name:          t.Name,
+			Breaker:       t.State().String(),
+			Pending:       t.inFlight(),
+			LMKCheckValue: info.LMKCheckValue,
+			Firmware:      info.Firmware,
+			CheckedAt:     info.checkedAt,
+		})
+	}
+	return status
+}
+
+// hsmInfo is what the HSM tells about itself in the diagnostics response.
+type hsmInfo struct {
+	thales.DiagnosticsResponse
+	checkedAt time.Time
+}
+
+// keepaliveLoop probes the connections that have been idle in the pools for
+// the keepalive interval until the context is done. The connections are
+// probed concurrently, so a slow HSM doesn't hold up the probes of the
+// others, and the next round starts once all the probes are done.
+func (b *broker) keepaliveLoop(ctx context.Context) error {
+	ticker := time.NewTicker(b.keepalive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, t := range b.targets {
+				for _, conn := range t.Pool.TakeIdle(b.keepalive) {
+					wg.Add(1)
+					go func(t *target, conn net.Conn) {
+						defer wg.Done()
+						b.probe(ctx, t, conn)
+					}(t, conn)
+				}
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// probe sends NC on the idle connection. The connection is returned to the
+// pool if the HSM answers and dropped otherwise.
+func (b *broker) probe(ctx context.Context, t *target, conn net.Conn) {
+	s := b.session(t, conn)
+	if s == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	req, err := thales.Encode(thales.Diagnostics{})
+	if err != nil {
+		t.Pool.Put(conn)
+		return
+	}
+	task := b.newTask(ctx, req, nil)
+	if _, err := b.write(task, t, conn, s); err != nil {
+		b.logger.Log("hsm", t.Name, "keepalive", "failed", "err", err)
+		return
+	}
+
+	var resp thales.DiagnosticsResponse
+	select {
+	case data := <-task.response:
+		err = thales.Decode(thales.Diagnostics{}, data, &resp)
+	case err = <-task.errCh:
+	case <-ctx.Done():
+		if b.failPending(task) {
+			b.targetFailed(t, ErrTimeout)
+		}
+		err = ErrTimeout
+	}
+	if err != nil {
+		b.logger.Log("hsm", t.Name, "keepalive", "failed", "err", err)
+		s.close(err)
+		b.releaseSession(t, conn)
+		return
+	}
+
+	t.infoMu.Lock()
+	t.info = hsmInfo{DiagnosticsResponse: resp, checkedAt: time.Now()}
+	t.infoMu.Unlock()
+	t.Pool.Put(conn)
+}
@@ -0,0 +1,47 @@
+package broker
+
+// idempotentCommands lists the host commands that may be retried on another
+// HSM once they have been written: they verify, translate or derive values
+// and leave no state behind on the HSM. Commands that are not listed are
+// never retried.
+var idempotentCommands = map[string]bool{
+	"B2": true, // echo
+	"BA": true, // encrypt a clear PIN
+	"BC": true, // verify a terminal PIN by comparison
+	"BE": true, // verify an interchange PIN by comparison
+	"BK": true, // generate an IBM offset for a customer PIN
+	"BU": true, // generate a key check value
+	"CA": true, // translate a PIN from TPK to ZPK
+	"CC": true, // translate a PIN from ZPK to ZPK
+	"DA": true, // verify a terminal PIN with the IBM method
+	"DC": true, // verify a terminal PIN with the Visa method
+	"DE": true, // generate an IBM offset
+	"DG": true, // generate a Visa PVV
+	"EA": true, // verify an interchange PIN with the IBM method
+	"EC": true, // verify an interchange PIN with the Visa method
+	"FW": true, // generate a Visa PVV for a customer PIN
+	"JC": true, // translate a PIN from TPK to LMK
+	"JE": true, // translate a PIN from ZPK to LMK
+	"NC": true, // perform diagnostics
+	"NO": true, // HSM status
+
+	// key generation must not be repeated
+	"A0": false, // generate a key
+	"FI": false, // generate a ZEK/ZAK
+	"HC": false, // generate a TMK, TPK or PVK
+	"IA": false, // generate a ZPK
+}
+
+// commandCode returns the command code of the request.
+func commandCode(req []byte) string {
+	if len(req) < 2 {
+		return ""
+	}
+	return string(req[:2])
+}
+
+// retryable reports whether the request may be retried on another HSM once
+// it has been written.
+func retryable(req []byte) bool {
+	return idempotentCommands[commandCode(req)]
+}
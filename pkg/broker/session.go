@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is a pooled HSM connection with a dedicated reader. Responses are
+// matched to the pending tasks by their header, so up to cap(slots)
+// commands may be in flight on the connection at once.
+type session struct {
+	conn   net.Conn
+	framer Framer
+	slots  chan struct{}
+	target *target
+
+	// lastRead is the time of the last response read, in Unix nanoseconds
+	lastRead int64
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newSession(conn net.Conn, f Framer, maxInFlight int, t *target) *session {
+	return &session{
+		conn:   conn,
+		framer: f,
+		slots:  make(chan struct{}, maxInFlight),
+		target: t,
+		done:   make(chan struct{}),
+	}
+}
+
+// read reads the responses from the connection with a reader that lives as
+// long as the connection and passes them to respond. It returns the error
+// that ended the session.
+func (s *session) read(respond func([]byte)) error {
+	r := bufio.NewReader(s.conn)
+	for {
+		resp, err := s.framer.ReadFrame(r)
+		if err != nil {
+			s.close(err)
+			return err
+		}
+		atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+		respond(resp)
+	}
+}
+
+// silentSince reports whether no response has been read since the time.
+func (s *session) silentSince(t time.Time) bool {
+	return atomic.LoadInt64(&s.lastRead) < t.UnixNano()
+}
+
+// release frees the slot of a task that is no longer in flight.
+func (s *session) release() {
+	atomic.AddInt64(&s.target.pending, -1)
+	select {
+	case <-s.slots:
+	default:
+	}
+}
+
+// close ends the session with the error and closes the connection.
+func (s *session) close(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// Err returns the error that ended the session.
+func (s *session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
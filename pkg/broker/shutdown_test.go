@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+	"github.com/go-kit/log"
+)
+
+func TestShutdownClosedPool(t *testing.T) {
+	var targets []Target
+	for _, name := range []string{"a", "b"} {
+		targets = append(targets, Target{Name: name, Pool: pool.NewPool(1, func(context.Context) (net.Conn, error) {
+			client, _ := net.Pipe()
+			return client, nil
+		})})
+	}
+	b := NewMultiBroker(targets, 1, log.NewNopLogger(), WithFailureThreshold(1))
+
+	// a task a worker took from the queue as Shutdown closes the pools
+	b.closing = true
+	for _, t := range b.targets {
+		t.Pool.Close()
+	}
+	task := b.newTask(context.Background(), []byte("B20004echo"), nil)
+	b.dispatch(task)
+
+	if err := <-task.errCh; !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("got %v, want %v", err, ErrShuttingDown)
+	}
+	for _, hsm := range b.targets {
+		if s := hsm.State(); s != Closed {
+			t.Errorf("breaker of %s is %s, want %s", hsm.Name, s, Closed)
+		}
+	}
+}
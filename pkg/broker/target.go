@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+)
+
+var ErrNoTarget = errors.New("no hsm available")
+
+// Strategy selects the HSM a task is sent to.
+type Strategy int
+
+const (
+	// RoundRobin spreads the tasks over the HSMs in proportion to their
+	// weights.
+	RoundRobin Strategy = iota
+	// LeastPending sends the task to the HSM with the fewest commands in
+	// flight relative to its weight.
+	LeastPending
+	// PrimaryStandby sends every task to the first available HSM in the
+	// order they are configured.
+	PrimaryStandby
+)
+
+var strategies = map[string]Strategy{
+	"round-robin":     RoundRobin,
+	"least-pending":   LeastPending,
+	"primary-standby": PrimaryStandby,
+}
+
+// ParseStrategy returns the strategy of the name: round-robin, least-pending
+// or primary-standby.
+func ParseStrategy(name string) (Strategy, error) {
+	s, ok := strategies[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown strategy %q", name)
+	}
+	return s, nil
+}
+
+// Target is an HSM endpoint of the broker.
+type Target struct {
+	Name   string
+	Pool   pool.Pool[net.Conn]
+	Weight int
+}
+
+// target is the state of a Target. Its circuit breaker takes it out of
+// rotation after consecutive connection or timeout failures.
+type target struct {
+	Target
+	circuit
+
+	// pending is the number of commands in flight
+	pending int64
+
+	// current weight of the smooth weighted round-robin
+	current int
+
+	infoMu sync.Mutex
+	info   hsmInfo
+}
+
+// inFlight returns the number of commands in flight on the target.
+func (t *target) inFlight() int64 {
+	return atomic.LoadInt64(&t.pending)
+}
+
+// available reports whether a target not in the excluded set is available.
+func (b *broker) available(exclude map[*target]bool) bool {
+	now := time.Now()
+	for _, t := range b.targets {
+		if !exclude[t] && t.allows(now, b.recoveryInterval) {
+			return true
+		}
+	}
+	return false
+}
+
+// pick selects an available target not in the excluded set and records
+// that a command is sent to it. The trial of a half-open breaker is claimed
+// under the same lock, so that a single caller gets it.
+func (b *broker) pick(exclude map[*target]bool) *target {
+	b.pickMu.Lock()
+	now := time.Now()
+	t := b.choose(now, exclude)
+	var from, to State
+	if t != nil {
+		from, to = t.begin(now)
+	}
+	b.pickMu.Unlock()
+
+	if from != to {
+		b.stateChanged(t, from, to, nil)
+	}
+	return t
+}
+
+// choose selects an available target not in the excluded set with the
+// strategy. The caller holds the pick lock.
+func (b *broker) choose(now time.Time, exclude map[*target]bool) *target {
+	var candidates []*target
+	for _, t := range b.targets {
+		if !exclude[t] && t.allows(now, b.recoveryInterval) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch b.strategy {
+	case LeastPending:
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			// pending/weight < best.pending/best.weight
+			if t.inFlight()*int64(best.Weight) < best.inFlight()*int64(t.Weight) {
+				best = t
+			}
+		}
+		return best
+	case PrimaryStandby:
+		return candidates[0]
+	}
+
+	// smooth weighted round-robin
+	var (
+		best  *target
+		total int
+	)
+	for _, t := range candidates {
+		t.current += t.Weight
+		total += t.Weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// targetFailed counts the failure of the target on its breaker.
+func (b *broker) targetFailed(t *target, err error) {
+	if from, to := t.failure(time.Now(), b.failureThreshold); from != to {
+		b.stateChanged(t, from, to, err)
+	}
+}
+
+// targetSucceeded closes the breaker of the target.
+func (b *broker) targetSucceeded(t *target) {
+	if from, to := t.success(); from != to {
+		b.stateChanged(t, from, to, nil)
+	}
+}
+
+func (b *broker) stateChanged(t *target, from, to State, err error) {
+	b.logger.Log("hsm", t.Name, "breaker", to, "from", from, "err", err)
+	b.breakerChanges.With("hsm", t.Name, "state", to.String()).Add(1)
+	b.breakerState.With("hsm", t.Name).Set(float64(to))
+}
@@ -0,0 +1,38 @@
+package broker
+
+// taskIDDigits are the characters of the task IDs.
+const taskIDDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// maxHeaderLength keeps the number of task IDs within a uint64.
+const maxHeaderLength = 12
+
+// nextTaskID returns the next ID of the broker sequence that no pending task
+// holds. The sequence wraps around after all IDs of the header length. The
+// caller holds the broker lock.
+func (b *broker) nextTaskID() (string, error) {
+	space := uint64(1)
+	for i := 0; i < b.headerLength; i++ {
+		space *= uint64(len(taskIDDigits))
+	}
+
+	// one of any len(pending)+1 consecutive IDs is free, unless all IDs are
+	// in use
+	for i := 0; i <= len(b.pending) && uint64(i) < space; i++ {
+		id := formatTaskID(b.seq%space, b.headerLength)
+		b.seq++
+		if _, ok := b.pending[id]; !ok {
+			return id, nil
+		}
+	}
+	return "", ErrNoTaskID
+}
+
+// formatTaskID writes n as a zero padded base 36 number of the length.
+func formatTaskID(n uint64, length int) string {
+	id := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		id[i] = taskIDDigits[n%uint64(len(taskIDDigits))]
+		n /= uint64(len(taskIDDigits))
+	}
+	return string(id)
+}
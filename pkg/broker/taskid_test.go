@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestTaskIDWraparound(t *testing.T) {
+	b := NewBroker(nil, 1, log.NewNopLogger(), WithHeaderLength(1))
+	b.seq = 34
+	b.pending["0"] = &Task{}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		id, err := b.nextTaskID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id)
+	}
+	// Y and Z are the last IDs, 0 is pending
+	if want := []string{"Y", "Z", "1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got IDs %v, want %v", got, want)
+	}
+
+	for i := 0; i < len(taskIDDigits); i++ {
+		b.pending[taskIDDigits[i:i+1]] = &Task{}
+	}
+	if _, err := b.nextTaskID(); !errors.Is(err, ErrNoTaskID) {
+		t.Errorf("all IDs pending: got %v, want %v", err, ErrNoTaskID)
+	}
+}
+
+func TestFailPendingReusedID(t *testing.T) {
+	b := NewBroker(nil, 1, log.NewNopLogger(), WithHeaderLength(1), WithMaxInFlight(2))
+	hsm := b.targets[0]
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	s := newSession(client, b.framer, 2, hsm)
+
+	send := func() *Task {
+		t.Helper()
+		task := b.newTask(context.Background(), []byte("B20004echo"), nil)
+		s.slots <- struct{}{}
+		atomic.AddInt64(&hsm.pending, 1)
+		if err := b.addTask(task, s); err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+
+	first := send()
+	// the first task is answered while its caller gives up on it
+	b.respondPending(s, []byte(first.taskID+"B300echo"))
+	// the ID wraps around to the one of the first task
+	b.seq += uint64(len(taskIDDigits)) - 1
+	second := send()
+	if second.taskID != first.taskID {
+		t.Fatalf("got ID %s, want the reused %s", second.taskID, first.taskID)
+	}
+
+	if b.failPending(first) {
+		t.Error("the answered task was failed")
+	}
+	if b.pending[second.taskID] != second {
+		t.Error("the task holding the reused ID was removed")
+	}
+	if n := hsm.inFlight(); n != 1 || len(s.slots) != 1 {
+		t.Errorf("%d commands in flight, %d slots taken, want 1", n, len(s.slots))
+	}
+}
@@ -0,0 +1,9 @@
+package domain
+
+// PINChange describes a change of PIN: the PIN block is verified against
+// the stored PVV, offset or PIN under LMK, and the new PIN block, encrypted
+// under the same key and format, replaces it.
+type PINChange struct {
+	PIN
+	NewEncryptedPIN string `json:"new_encrypted_pin,omitempty"`
+}
@@ -0,0 +1,8 @@
+package domain
+
+// KeyRef references a key in the key store by its logical name and version.
+// Version 0 refers to the latest version of the key.
+type KeyRef struct {
+	Name    string `json:"name"`
+	Version int    `json:"version,omitempty"`
+}
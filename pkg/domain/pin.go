@@ -7,5 +7,21 @@ type PIN struct {
 	Length       int    `json:"length,omitempty"`
 	PAN          string `json:"pan,omitempty"`
 	EncryptedPIN string `json:"encrypted_pin,omitempty"`
-	PVV          string `json:"pvv,omitempty"`
+	Format       string `json:"format,omitempty"`
+
+	// Key is the TPK or ZPK the PIN block is encrypted under.
+	Key KeyRef `json:"key"`
+	PVV string `json:"pvv,omitempty"`
+
+	// Method overrides the verification method of the BIN range.
+	Method string `json:"method,omitempty"`
+	// LMKPIN is the stored PIN encrypted under the LMK, which the comparison
+	// method verifies the PIN block against.
+	LMKPIN string `json:"lmk_pin,omitempty"`
+
+	// IBM 3624 offset parameters.
+	DecimalisationTable string `json:"decimalisation_table,omitempty"`
+	ValidationData      string `json:"validation_data,omitempty"`
+	CheckLength         int    `json:"check_length,omitempty"`
+	Offset              string `json:"offset,omitempty"`
 }
@@ -0,0 +1,14 @@
+package domain
+
+// Translation describes a PIN block to be re-encrypted from the source TPK
+// or ZPK to the destination ZPK.
+type Translation struct {
+	RequestId string `json:"-"`
+
+	SourceKey         KeyRef `json:"source_key"`
+	DestinationKey    KeyRef `json:"destination_key"`
+	SourceFormat      string `json:"source_format,omitempty"`
+	DestinationFormat string `json:"destination_format,omitempty"`
+	PAN               string `json:"pan,omitempty"`
+	EncryptedPIN      string `json:"encrypted_pin,omitempty"`
+}
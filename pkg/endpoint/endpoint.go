@@ -44,8 +44,8 @@ type GeneratePVVRequest struct {
 
 // GeneratePVVResponse collects the response parameters for the GeneratePVV method.
 type GeneratePVVResponse struct {
-	S0 string `json:"s0"`
-	E1 error  `json:"e1"`
+	PVV string `json:"pvv"`
+	E1  error  `json:"error"`
 }
 
 // MakeGeneratePVVEndpoint returns an endpoint that invokes GeneratePVV on the service.
@@ -54,8 +54,8 @@ func MakeGeneratePVVEndpoint(s service.PinService) endpoint.Endpoint {
 		req := request.(GeneratePVVRequest).PIN
 		s0, e1 := s.GeneratePVV(ctx, req)
 		return GeneratePVVResponse{
-			E1: e1,
-			S0: s0,
+			E1:  e1,
+			PVV: s0,
 		}, nil
 	}
 }
@@ -65,6 +65,185 @@ func (r GeneratePVVResponse) Failed() error {
 	return r.E1
 }
 
+// GenerateOffsetRequest collects the request parameters for the GenerateOffset method.
+type GenerateOffsetRequest struct {
+	*domain.PIN
+}
+
+// GenerateOffsetResponse collects the response parameters for the GenerateOffset method.
+type GenerateOffsetResponse struct {
+	Offset string `json:"offset"`
+	E1     error  `json:"error"`
+}
+
+// MakeGenerateOffsetEndpoint returns an endpoint that invokes GenerateOffset on the service.
+func MakeGenerateOffsetEndpoint(s service.PinService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GenerateOffsetRequest).PIN
+		s0, e1 := s.GenerateOffset(ctx, req)
+		return GenerateOffsetResponse{
+			E1:     e1,
+			Offset: s0,
+		}, nil
+	}
+}
+
+// Failed implements Failer.
+func (r GenerateOffsetResponse) Failed() error {
+	return r.E1
+}
+
+// VerifyOffsetRequest collects the request parameters for the VerifyOffset method.
+type VerifyOffsetRequest struct {
+	*domain.PIN
+}
+
+// VerifyOffsetResponse collects the response parameters for the VerifyOffset method.
+type VerifyOffsetResponse struct {
+	Success bool  `json:"success"`
+	E0      error `json:"error"`
+}
+
+// MakeVerifyOffsetEndpoint returns an endpoint that invokes VerifyOffset on the service.
+func MakeVerifyOffsetEndpoint(s service.PinService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		var isSuccess bool
+		req := request.(VerifyOffsetRequest).PIN
+		e0 := s.VerifyOffset(ctx, req)
+		if e0 == nil {
+			isSuccess = true
+		}
+		return VerifyOffsetResponse{Success: isSuccess, E0: e0}, e0
+	}
+}
+
+// Failed implements Failer.
+func (r VerifyOffsetResponse) Failed() error {
+	return r.E0
+}
+
+// TranslatePINRequest collects the request parameters for the TranslatePIN method.
+type TranslatePINRequest struct {
+	*domain.Translation
+}
+
+// TranslatePINResponse collects the response parameters for the TranslatePIN method.
+type TranslatePINResponse struct {
+	EncryptedPIN string `json:"encrypted_pin"`
+	E1           error  `json:"error"`
+}
+
+// MakeTranslatePINEndpoint returns an endpoint that invokes TranslatePIN on the service.
+func MakeTranslatePINEndpoint(s service.PinService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(TranslatePINRequest).Translation
+		s0, e1 := s.TranslatePIN(ctx, req)
+		return TranslatePINResponse{
+			E1:           e1,
+			EncryptedPIN: s0,
+		}, nil
+	}
+}
+
+// Failed implements Failer.
+func (r TranslatePINResponse) Failed() error {
+	return r.E1
+}
+
+// VerifyComparisonRequest collects the request parameters for the VerifyComparison method.
+type VerifyComparisonRequest struct {
+	*domain.PIN
+}
+
+// VerifyComparisonResponse collects the response parameters for the VerifyComparison method.
+type VerifyComparisonResponse struct {
+	Success bool  `json:"success"`
+	E0      error `json:"error"`
+}
+
+// MakeVerifyComparisonEndpoint returns an endpoint that invokes VerifyComparison on the service.
+func MakeVerifyComparisonEndpoint(s service.PinService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		var isSuccess bool
+		req := request.(VerifyComparisonRequest).PIN
+		e0 := s.VerifyComparison(ctx, req)
+		if e0 == nil {
+			isSuccess = true
+		}
+		return VerifyComparisonResponse{Success: isSuccess, E0: e0}, e0
+	}
+}
+
+// Failed implements Failer.
+func (r VerifyComparisonResponse) Failed() error {
+	return r.E0
+}
+
+// StorePINRequest collects the request parameters for the StorePIN method.
+type StorePINRequest struct {
+	*domain.PIN
+}
+
+// StorePINResponse collects the response parameters for the StorePIN method.
+type StorePINResponse struct {
+	LMKPIN string `json:"lmk_pin"`
+	E1     error  `json:"error"`
+}
+
+// MakeStorePINEndpoint returns an endpoint that invokes StorePIN on the service.
+func MakeStorePINEndpoint(s service.PinService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(StorePINRequest).PIN
+		s0, e1 := s.StorePIN(ctx, req)
+		return StorePINResponse{
+			E1:     e1,
+			LMKPIN: s0,
+		}, nil
+	}
+}
+
+// Failed implements Failer.
+func (r StorePINResponse) Failed() error {
+	return r.E1
+}
+
+// ChangePINRequest collects the request parameters for the ChangePIN method.
+type ChangePINRequest struct {
+	*domain.PINChange
+}
+
+// ChangePINResponse collects the response parameters for the ChangePIN method:
+// the verification data of the new PIN.
+type ChangePINResponse struct {
+	Method string `json:"method,omitempty"`
+	PVV    string `json:"pvv,omitempty"`
+	Offset string `json:"offset,omitempty"`
+	LMKPIN string `json:"lmk_pin,omitempty"`
+	E1     error  `json:"error"`
+}
+
+// MakeChangePINEndpoint returns an endpoint that invokes ChangePIN on the service.
+func MakeChangePINEndpoint(s service.PinService) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ChangePINRequest).PINChange
+		p0, e1 := s.ChangePIN(ctx, req)
+		if e1 != nil {
+			return ChangePINResponse{E1: e1}, nil
+		}
+		return ChangePINResponse{
+			Method: p0.Method,
+			PVV:    p0.PVV,
+			Offset: p0.Offset,
+			LMKPIN: p0.LMKPIN,
+		}, nil
+	}
+}
+
+// Failed implements Failer.
+func (r ChangePINResponse) Failed() error {
+	return r.E1
+}
+
 // Failure is an interface that should be implemented by response types.
 // Response encoders can check if responses are Failer, and if so they've
 // failed, and if so encode them using a separate write path based on the error.
@@ -86,7 +265,71 @@ func (e Endpoints) GeneratePVV(ctx context.Context, pin *domain.PIN) (s0 string,
 	request := GeneratePVVRequest{PIN: pin}
 	response, err := e.GeneratePVVEndpoint(ctx, request)
 	if err != nil {
-		return
+		return "", err
+	}
+	return response.(GeneratePVVResponse).PVV, response.(GeneratePVVResponse).E1
+}
+
+// GenerateOffset implements Service. Primarily useful in a client.
+func (e Endpoints) GenerateOffset(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	request := GenerateOffsetRequest{PIN: pin}
+	response, err := e.GenerateOffsetEndpoint(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return response.(GenerateOffsetResponse).Offset, response.(GenerateOffsetResponse).E1
+}
+
+// VerifyOffset implements Service. Primarily useful in a client.
+func (e Endpoints) VerifyOffset(ctx context.Context, pin *domain.PIN) (e0 error) {
+	request := VerifyOffsetRequest{PIN: pin}
+	response, err := e.VerifyOffsetEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	return response.(VerifyOffsetResponse).E0
+}
+
+// TranslatePIN implements Service. Primarily useful in a client.
+func (e Endpoints) TranslatePIN(ctx context.Context, t *domain.Translation) (s0 string, e1 error) {
+	request := TranslatePINRequest{Translation: t}
+	response, err := e.TranslatePINEndpoint(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return response.(TranslatePINResponse).EncryptedPIN, response.(TranslatePINResponse).E1
+}
+
+// VerifyComparison implements Service. Primarily useful in a client.
+func (e Endpoints) VerifyComparison(ctx context.Context, pin *domain.PIN) (e0 error) {
+	request := VerifyComparisonRequest{PIN: pin}
+	response, err := e.VerifyComparisonEndpoint(ctx, request)
+	if err != nil {
+		return err
+	}
+	return response.(VerifyComparisonResponse).E0
+}
+
+// StorePIN implements Service. Primarily useful in a client.
+func (e Endpoints) StorePIN(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	request := StorePINRequest{PIN: pin}
+	response, err := e.StorePINEndpoint(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return response.(StorePINResponse).LMKPIN, response.(StorePINResponse).E1
+}
+
+// ChangePIN implements Service. Primarily useful in a client.
+func (e Endpoints) ChangePIN(ctx context.Context, c *domain.PINChange) (p0 *domain.PIN, e1 error) {
+	request := ChangePINRequest{PINChange: c}
+	response, err := e.ChangePINEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	r := response.(ChangePINResponse)
+	if r.E1 != nil {
+		return nil, r.E1
 	}
-	return response.(GeneratePVVResponse).S0, response.(GeneratePVVResponse).E1
+	return &domain.PIN{PAN: c.PAN, Method: r.Method, PVV: r.PVV, Offset: r.Offset, LMKPIN: r.LMKPIN}, nil
 }
@@ -10,16 +10,28 @@ import (
 // meant to be used as a helper struct, to collect all of the endpoints into a
 // single parameter.
 type Endpoints struct {
-	VerifyEndpoint      endpoint.Endpoint
-	GeneratePVVEndpoint endpoint.Endpoint
+	VerifyEndpoint           endpoint.Endpoint
+	GeneratePVVEndpoint      endpoint.Endpoint
+	GenerateOffsetEndpoint   endpoint.Endpoint
+	VerifyOffsetEndpoint     endpoint.Endpoint
+	TranslatePINEndpoint     endpoint.Endpoint
+	VerifyComparisonEndpoint endpoint.Endpoint
+	StorePINEndpoint         endpoint.Endpoint
+	ChangePINEndpoint        endpoint.Endpoint
 }
 
 // New returns a Endpoints struct that wraps the provided service, and wires in all of the
 // expected endpoint middlewares
 func New(s service.PinService, mdw map[string][]endpoint.Middleware) Endpoints {
 	eps := Endpoints{
-		GeneratePVVEndpoint: MakeGeneratePVVEndpoint(s),
-		VerifyEndpoint:      MakeVerifyEndpoint(s),
+		GenerateOffsetEndpoint:   MakeGenerateOffsetEndpoint(s),
+		GeneratePVVEndpoint:      MakeGeneratePVVEndpoint(s),
+		VerifyEndpoint:           MakeVerifyEndpoint(s),
+		TranslatePINEndpoint:     MakeTranslatePINEndpoint(s),
+		VerifyOffsetEndpoint:     MakeVerifyOffsetEndpoint(s),
+		VerifyComparisonEndpoint: MakeVerifyComparisonEndpoint(s),
+		StorePINEndpoint:         MakeStorePINEndpoint(s),
+		ChangePINEndpoint:        MakeChangePINEndpoint(s),
 	}
 	for _, m := range mdw["Verify"] {
 		eps.VerifyEndpoint = m(eps.VerifyEndpoint)
@@ -27,5 +39,23 @@ func New(s service.PinService, mdw map[string][]endpoint.Middleware) Endpoints {
 	for _, m := range mdw["GeneratePVV"] {
 		eps.GeneratePVVEndpoint = m(eps.GeneratePVVEndpoint)
 	}
+	for _, m := range mdw["GenerateOffset"] {
+		eps.GenerateOffsetEndpoint = m(eps.GenerateOffsetEndpoint)
+	}
+	for _, m := range mdw["VerifyOffset"] {
+		eps.VerifyOffsetEndpoint = m(eps.VerifyOffsetEndpoint)
+	}
+	for _, m := range mdw["TranslatePIN"] {
+		eps.TranslatePINEndpoint = m(eps.TranslatePINEndpoint)
+	}
+	for _, m := range mdw["VerifyComparison"] {
+		eps.VerifyComparisonEndpoint = m(eps.VerifyComparisonEndpoint)
+	}
+	for _, m := range mdw["StorePIN"] {
+		eps.StorePINEndpoint = m(eps.StorePINEndpoint)
+	}
+	for _, m := range mdw["ChangePIN"] {
+		eps.ChangePINEndpoint = m(eps.ChangePINEndpoint)
+	}
 	return eps
 }
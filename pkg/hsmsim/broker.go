@@ -0,0 +1,28 @@
+//go:build !production
+
+package hsmsim
+
+import (
+	"context"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+	log "github.com/go-kit/log"
+)
+
+// Broker is a broker.Broker connected to the simulator in process.
+type Broker interface {
+	broker.Broker
+	// Close stops the broker and its connections.
+	Close()
+}
+
+// NewBroker returns a broker of the simulator for tests. It is the broker of
+// the service with in-memory connections dialed by Server.Dial, so the
+// commands go through the framing and the header correlation of the real
+// ones. The options must match the framing of the server.
+func NewBroker(s *Server, opts ...broker.Option) Broker {
+	b := broker.NewBroker(pool.NewPool(2, s.Dial), 2, log.NewNopLogger(), opts...)
+	go b.Start(context.Background())
+	return b
+}
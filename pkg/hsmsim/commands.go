@@ -0,0 +1,405 @@
+//go:build !production
+
+package hsmsim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrei-cloud/pinservice/pkg/pincrypto"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+// pinBlock is an encrypted PIN block with its format code and the account
+// number field of the format.
+type pinBlock struct {
+	block   []byte
+	format  string
+	account string
+}
+
+// pinBlockFields reads a PIN block, its format code and its account number.
+func (r *reader) pinBlockFields() pinBlock {
+	var p pinBlock
+	p.block = r.pinBlock()
+	p.format = r.blockFormat()
+	p.account = r.account(p.format)
+	return p
+}
+
+// decrypt returns the PIN of the PIN block encrypted under the key.
+func (p pinBlock) decrypt(key []byte) (string, error) {
+	return decryptPINBlock(key, p.block, p.account, p.format)
+}
+
+// keys returns the clear keys of the key fields.
+func (s *Simulator) keys(fields ...string) ([][]byte, error) {
+	keys := make([][]byte, len(fields))
+	for i, f := range fields {
+		k, err := s.key(f)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+// echo is B2: return the data of the command.
+func (s *Simulator) echo(r *reader) (string, error) {
+	length := r.hex(4)
+	data := r.rest(0)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	if fmt.Sprintf("%04X", len(data)) != strings.ToUpper(length) {
+		return "", errInvalidInput
+	}
+	return data, nil
+}
+
+// encryptPIN is BA: encrypt a clear PIN under the LMK.
+func (s *Simulator) encryptPIN(r *reader) (string, error) {
+	pin := r.rest(12)
+	account := r.numeric(12)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	pin = strings.TrimRight(pin, "F")
+	if len(pin) < 4 || len(pin) > 12 || strings.Trim(pin, "0123456789") != "" {
+		return "", errPINLength
+	}
+	return s.encryptLMKPIN(pin, account), nil
+}
+
+// verifyComparison is BC and BE: verify a PIN by comparison with the PIN
+// encrypted under the LMK.
+func (s *Simulator) verifyComparison(r *reader) (string, error) {
+	keyField := r.key()
+	block := r.pinBlockFields()
+	enc := r.rest(0)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	key, err := s.key(keyField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := block.decrypt(key)
+	if err != nil {
+		return "", err
+	}
+	want, err := s.decryptLMKPIN(enc, accountNumber(block.account))
+	if err != nil {
+		return "", err
+	}
+	if pin != want {
+		return "", errVerification
+	}
+	return "", nil
+}
+
+// translateToLMK is JC and JE: translate a PIN block to encryption under
+// the LMK.
+func (s *Simulator) translateToLMK(r *reader) (string, error) {
+	keyField := r.key()
+	block := r.pinBlockFields()
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	key, err := s.key(keyField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := block.decrypt(key)
+	if err != nil {
+		return "", err
+	}
+	return s.encryptLMKPIN(pin, accountNumber(block.account)), nil
+}
+
+// verifyPVV is DC and EC: verify a PIN with the Visa PVV method.
+func (s *Simulator) verifyPVV(r *reader) (string, error) {
+	keyField := r.key()
+	pvkField := r.hex(32)
+	block := r.pinBlockFields()
+	pvki := r.numeric(1)
+	want := r.numeric(4)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	keys, err := s.keys(keyField, pvkField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := block.decrypt(keys[0])
+	if err != nil {
+		return "", err
+	}
+
+	got, err := pincrypto.PVV(keys[1], pan(accountNumber(block.account)), pvki, pin)
+	if err != nil {
+		return "", err
+	}
+	if got != want {
+		return "", errVerification
+	}
+	return "", nil
+}
+
+// generatePVV is DG: generate the PVV of a PIN encrypted under the LMK.
+func (s *Simulator) generatePVV(r *reader) (string, error) {
+	pvkField := r.hex(32)
+	// account number and PVKI
+	enc := r.rest(12 + 1)
+	account := r.numeric(12)
+	pvki := r.numeric(1)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	pvk, err := s.key(pvkField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := s.decryptLMKPIN(enc, account)
+	if err != nil {
+		return "", err
+	}
+	return pincrypto.PVV(pvk, pan(account), pvki, pin)
+}
+
+// generateCustomerPVV is FW: generate the PVV of a customer selected PIN.
+func (s *Simulator) generateCustomerPVV(r *reader) (string, error) {
+	keyField := r.key()
+	pvkField := r.hex(32)
+	block := r.pinBlockFields()
+	pvki := r.numeric(1)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	keys, err := s.keys(keyField, pvkField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := block.decrypt(keys[0])
+	if err != nil {
+		return "", err
+	}
+	return pincrypto.PVV(keys[1], pan(accountNumber(block.account)), pvki, pin)
+}
+
+// ibm is the IBM 3624 parameters of the offset commands.
+type ibm struct {
+	checkLength int
+	// account is the account number field of the PIN block format
+	account    string
+	table      string
+	validation string
+}
+
+func (r *reader) ibm(format string) ibm {
+	var p ibm
+	p.checkLength = r.number(2)
+	p.account = r.account(format)
+	p.table = r.take(16)
+	p.validation = r.take(12)
+	if r.err != nil {
+		return p
+	}
+	if p.checkLength < 4 || p.checkLength > 12 {
+		r.fail(errInvalidInput)
+	}
+	if strings.Trim(p.table, "0123456789") != "" {
+		r.fail(errDecimalisation)
+	}
+	return p
+}
+
+// offset returns the IBM 3624 offset of the PIN, as long as the PIN. The
+// 5 rightmost digits of the account number take the place of N in the
+// validation data.
+func (p ibm) offset(pvk []byte, pin string) (string, error) {
+	if len(pin) < p.checkLength {
+		return "", errPINLength
+	}
+	account := accountNumber(p.account)
+	validation := strings.Replace(p.validation, "N", account[len(account)-5:], 1)
+	return pincrypto.IBMOffset(pvk, pin, validation, p.table)
+}
+
+// verifyOffset is DA and EA: verify a PIN with the IBM 3624 offset method.
+// The check length leftmost digits of the offset are verified.
+func (s *Simulator) verifyOffset(r *reader) (string, error) {
+	keyField := r.key()
+	pvkField := r.key()
+	maxLength := r.number(2)
+	block := r.pinBlock()
+	format := r.blockFormat()
+	p := r.ibm(format)
+	want := strings.TrimRight(r.take(12), "F")
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	keys, err := s.keys(keyField, pvkField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := decryptPINBlock(keys[0], block, p.account, format)
+	if err != nil {
+		return "", err
+	}
+	if len(pin) > maxLength {
+		return "", errPINLength
+	}
+
+	got, err := p.offset(keys[1], pin)
+	if err != nil {
+		return "", err
+	}
+	if len(want) < p.checkLength || got[:p.checkLength] != want[:p.checkLength] {
+		return "", errVerification
+	}
+	return "", nil
+}
+
+// generateOffset is DE: generate the offset of a PIN encrypted under the
+// LMK.
+func (s *Simulator) generateOffset(r *reader) (string, error) {
+	pvkField := r.key()
+	// check length, account number, decimalisation table and validation
+	// data
+	enc := r.rest(2 + 12 + 16 + 12)
+	p := r.ibm(thales.FormatISO0)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	pvk, err := s.key(pvkField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := s.decryptLMKPIN(enc, p.account)
+	if err != nil {
+		return "", err
+	}
+	offset, err := p.offset(pvk, pin)
+	if err != nil {
+		return "", err
+	}
+	return padOffset(offset), nil
+}
+
+// generateCustomerOffset is BK: generate the offset of a customer selected
+// PIN.
+func (s *Simulator) generateCustomerOffset(r *reader) (string, error) {
+	// key type: 001 - ZPK, 002 - TPK
+	if keyType := r.numeric(3); r.err == nil && keyType != "001" && keyType != "002" {
+		r.fail(errInvalidInput)
+	}
+	keyField := r.key()
+	pvkField := r.key()
+	block := r.pinBlock()
+	format := r.blockFormat()
+	p := r.ibm(format)
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	keys, err := s.keys(keyField, pvkField)
+	if err != nil {
+		return "", err
+	}
+	pin, err := decryptPINBlock(keys[0], block, p.account, format)
+	if err != nil {
+		return "", err
+	}
+	offset, err := p.offset(keys[1], pin)
+	if err != nil {
+		return "", err
+	}
+	return padOffset(offset), nil
+}
+
+// padOffset returns the offset left justified and padded with F to 12
+// characters.
+func padOffset(offset string) string {
+	return offset + strings.Repeat("F", 12-len(offset))
+}
+
+// translatePIN is CA and CC: translate a PIN block to a ZPK.
+func (s *Simulator) translatePIN(r *reader) (string, error) {
+	srcField := r.key()
+	dstField := r.key()
+	maxLength := r.number(2)
+	block := r.pinBlock()
+	srcFormat := r.blockFormat()
+	dstFormat := r.format()
+	account := r.account(translationFormat(srcFormat, dstFormat))
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	keys, err := s.keys(srcField, dstField)
+	if err != nil {
+		return "", err
+	}
+
+	pin, err := decryptPINBlock(keys[0], block, formatAccount(account, srcFormat), srcFormat)
+	if err != nil {
+		return "", err
+	}
+	if len(pin) > maxLength {
+		return "", errPINLength
+	}
+	out, err := encryptPINBlock(keys[1], pin, formatAccount(account, dstFormat), dstFormat)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%02d%X%s", len(pin), out, dstFormat), nil
+}
+
+// translationFormat returns the format of the account number field of a
+// translation: ISO 4 if either side is ISO 4.
+func translationFormat(src, dst string) string {
+	if src == thales.FormatISO4 || dst == thales.FormatISO4 {
+		return thales.FormatISO4
+	}
+	return src
+}
+
+// formatAccount returns the account number field of the format from the
+// account number field of a translation.
+func formatAccount(account, format string) string {
+	if format == thales.FormatISO4 {
+		return account
+	}
+	return accountNumber(account)
+}
+
+// diagnostics is NC: return the LMK check value and the firmware number.
+func (s *Simulator) diagnostics(r *reader) (string, error) {
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	return s.lmkCheck + s.Firmware, nil
+}
+
+// keyCheckValue is BU: generate the check value of a key encrypted under
+// the LMK.
+func (s *Simulator) keyCheckValue(r *reader) (string, error) {
+	r.take(2) // key type code
+	flag := r.number(1)
+	field := r.key()
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	// key length flag: 0 - single, 1 - double, 2 - triple
+	if flag > 2 {
+		return "", errKeyLengthFlag
+	}
+	if len(field) != 16*(flag+1) {
+		return "", errKeyLength
+	}
+	key, err := s.key(field)
+	if err != nil {
+		return "", err
+	}
+	return pincrypto.CheckValue(key)
+}
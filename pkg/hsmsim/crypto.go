@@ -0,0 +1,72 @@
+//go:build !production
+
+package hsmsim
+
+import (
+	"crypto/cipher"
+
+	"github.com/andrei-cloud/pinservice/pkg/pincrypto"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+// cryptoErrors maps the errors of pincrypto to the error codes.
+var cryptoErrors = map[error]errorCode{
+	pincrypto.ErrKeyLength:      errKeyLength,
+	pincrypto.ErrPINLength:      errPINLength,
+	pincrypto.ErrPINBlock:       errPINBlock,
+	pincrypto.ErrFormat:         errFormat,
+	pincrypto.ErrDecimalisation: errDecimalisation,
+	pincrypto.ErrDisabled:       errDisabled,
+}
+
+// formats maps the PIN block format codes to the formats of pincrypto.
+var formats = map[string]pincrypto.Format{
+	thales.FormatISO0: pincrypto.ISO0,
+	thales.FormatISO1: pincrypto.ISO1,
+	thales.FormatISO3: pincrypto.ISO3,
+	thales.FormatISO4: pincrypto.ISO4,
+}
+
+func encryptECB(c cipher.Block, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i+c.BlockSize() <= len(data); i += c.BlockSize() {
+		c.Encrypt(out[i:], data[i:])
+	}
+	return out
+}
+
+func decryptECB(c cipher.Block, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i+c.BlockSize() <= len(data); i += c.BlockSize() {
+		c.Decrypt(out[i:], data[i:])
+	}
+	return out
+}
+
+// pan returns a PAN of the 12 digit account number for pincrypto. Its
+// check digit is not used.
+func pan(account string) string {
+	return account + "0"
+}
+
+// formatPAN returns the PAN of the account number field of the format: the
+// PAN of ISO 4, a PAN of the account number otherwise.
+func formatPAN(account, format string) string {
+	if format == thales.FormatISO4 {
+		return account
+	}
+	return pan(account)
+}
+
+// encryptPINBlock returns the PIN block of the format encrypted under the
+// key. ISO 4 blocks are encrypted with AES, using the double length key as
+// an AES-128 key; the account is then the full PAN.
+func encryptPINBlock(key []byte, pin, account, format string) ([]byte, error) {
+	return pincrypto.EncryptPINBlock(key, pin, formatPAN(account, format), formats[format])
+}
+
+// decryptPINBlock returns the PIN of the PIN block of the format encrypted
+// under the key.
+func decryptPINBlock(key, block []byte, account, format string) (string, error) {
+	return pincrypto.DecryptPINBlock(key, block, formatPAN(account, format), formats[format])
+}
@@ -0,0 +1,138 @@
+//go:build !production
+
+package hsmsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fault kinds.
+const (
+	// FaultLatency delays the reply, letting the later replies overtake it.
+	FaultLatency = "latency"
+	// FaultDrop never sends the reply.
+	FaultDrop = "drop"
+	// FaultTruncate cuts the reply short within a well formed frame.
+	FaultTruncate = "truncate"
+	// FaultWrongHeader replies with a header no command was sent with.
+	FaultWrongHeader = "wrong-header"
+	// FaultGarbage writes unframed random bytes ahead of the reply.
+	FaultGarbage = "garbage"
+	// FaultDisconnect closes the connection halfway through the reply.
+	FaultDisconnect = "disconnect"
+)
+
+var faultKinds = map[string]bool{
+	FaultLatency:     true,
+	FaultDrop:        true,
+	FaultTruncate:    true,
+	FaultWrongHeader: true,
+	FaultGarbage:     true,
+	FaultDisconnect:  true,
+}
+
+// Duration is a time.Duration written as a string, e.g. "250ms", in the
+// scenario files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Fault is a failure the server injects into the replies.
+type Fault struct {
+	Kind string `json:"kind"`
+	// Command limits the fault to the command code, it applies to all the
+	// commands if empty.
+	Command string `json:"command,omitempty"`
+	// Rate is the probability that the fault hits a command, 1 if zero.
+	Rate float64 `json:"rate,omitempty"`
+	// Latency is the delay of the latency fault.
+	Latency Duration `json:"latency,omitempty"`
+	// Length is the number of bytes the truncate fault keeps, half of the
+	// reply if zero.
+	Length int `json:"length,omitempty"`
+}
+
+// Scenario is the faults injected by a server. The first fault that hits a
+// command applies to its reply.
+type Scenario struct {
+	Faults []Fault `json:"faults"`
+	// Seed seeds the random hits, which are the same from run to run for
+	// the same sequence of commands.
+	Seed int64 `json:"seed,omitempty"`
+
+	once sync.Once
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+func (s *Scenario) validate() error {
+	for i, f := range s.Faults {
+		if !faultKinds[f.Kind] {
+			return fmt.Errorf("fault %d: unknown kind %q", i, f.Kind)
+		}
+		if f.Rate < 0 || f.Rate > 1 {
+			return fmt.Errorf("fault %d: rate %v is not between 0 and 1", i, f.Rate)
+		}
+	}
+	return nil
+}
+
+// fault returns the fault that hits the command, or nil. A nil scenario
+// injects no faults.
+func (s *Scenario) fault(cmd []byte) *Fault {
+	if s == nil {
+		return nil
+	}
+	s.once.Do(func() {
+		s.rand = rand.New(rand.NewSource(s.Seed))
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.Faults {
+		f := &s.Faults[i]
+		if f.Command != "" && (len(cmd) < 2 || string(cmd[:2]) != f.Command) {
+			continue
+		}
+		if f.Rate == 0 || s.rand.Float64() < f.Rate {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+//go:build !production
+
+// Package hsmsim simulates a payShield HSM for local development and tests.
+// It executes the host commands of the service with the PIN math of
+// pincrypto under a test LMK.
+//
+// Keys and PINs are encrypted under the LMK with a scheme of its own: keys
+// are TDES-ECB encrypted under the double length LMK without variants, and
+// PINs are digits masked with an account dependent keystream. It is not a
+// payShield and holds no secret worth protecting.
+//
+// Like pincrypto, the simulator is left out of production builds.
+package hsmsim
+
+import (
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/andrei-cloud/pinservice/pkg/pincrypto"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+const (
+	// DefaultLMK is the test LMK the keys of config/keys.json are encrypted
+	// under.
+	DefaultLMK = "DFAEBFECEAFBEFDFAEBFECEAFBEFDFAE"
+	// DefaultFirmware is the firmware number returned by NC.
+	DefaultFirmware = "1500-0023"
+)
+
+var ErrInvalidLMK = errors.New("lmk must be a double or triple length key")
+
+// errorCode is the error code of a failed command.
+type errorCode string
+
+func (c errorCode) Error() string { return "hsm error code " + string(c) }
+
+const (
+	errVerification   errorCode = "01"
+	errKeyLength      errorCode = "02"
+	errKeyLengthFlag  errorCode = "05"
+	errLMKPIN         errorCode = "14"
+	errInvalidInput   errorCode = "15"
+	errPINBlock       errorCode = "20"
+	errFormat         errorCode = "23"
+	errPINLength      errorCode = "24"
+	errDecimalisation errorCode = "25"
+	errKeyScheme      errorCode = "26"
+	errDisabled       errorCode = "68"
+)
+
+// handler executes a command and returns the response fields that follow
+// the error code.
+type handler func(s *Simulator, r *reader) (string, error)
+
+var commands = map[string]handler{
+	"B2": (*Simulator).echo,
+	"BA": (*Simulator).encryptPIN,
+	"BC": (*Simulator).verifyComparison,
+	"BE": (*Simulator).verifyComparison,
+	"BK": (*Simulator).generateCustomerOffset,
+	"BU": (*Simulator).keyCheckValue,
+	"CA": (*Simulator).translatePIN,
+	"CC": (*Simulator).translatePIN,
+	"DA": (*Simulator).verifyOffset,
+	"DC": (*Simulator).verifyPVV,
+	"DE": (*Simulator).generateOffset,
+	"DG": (*Simulator).generatePVV,
+	"EA": (*Simulator).verifyOffset,
+	"EC": (*Simulator).verifyPVV,
+	"FW": (*Simulator).generateCustomerPVV,
+	"JC": (*Simulator).translateToLMK,
+	"JE": (*Simulator).translateToLMK,
+	"NC": (*Simulator).diagnostics,
+}
+
+// Simulator executes host commands. It holds no state besides the LMK and
+// is safe for concurrent use.
+type Simulator struct {
+	lmk      cipher.Block
+	lmkCheck string
+	// Firmware is the firmware number returned by NC.
+	Firmware string
+}
+
+// New returns a simulator with the LMK, a double or triple length key in
+// hexadecimal.
+func New(lmk string) (*Simulator, error) {
+	key, err := hex.DecodeString(lmk)
+	if err != nil || (len(key) != 16 && len(key) != 24) {
+		return nil, ErrInvalidLMK
+	}
+	c, err := pincrypto.NewTDES(key)
+	if err != nil {
+		return nil, err
+	}
+	kcv, err := pincrypto.CheckValue(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Simulator{
+		lmk:      c,
+		lmkCheck: pincrypto.Decimalise(kcv, "0123456789012345"),
+		Firmware: DefaultFirmware,
+	}, nil
+}
+
+// Handle executes the command message, without its header, and returns the
+// response message: the response code, the error code and the response
+// fields.
+func (s *Simulator) Handle(msg []byte) []byte {
+	if len(msg) < 2 {
+		return []byte("ZZ" + string(errInvalidInput))
+	}
+	code := string(msg[:2])
+	resp := thales.ResponseCode(code)
+	h, ok := commands[code]
+	if !ok {
+		return []byte(resp + string(errDisabled))
+	}
+
+	r := &reader{data: msg[2:]}
+	fields, err := h(s, r)
+	if r.err != nil && r.block {
+		// the 16H PIN block didn't fit, try the 32H of ISO 4
+		wide := &reader{data: msg[2:], wide: true}
+		if f, e := h(s, wide); wide.err == nil {
+			fields, err = f, e
+		}
+	}
+	if err != nil {
+		var c errorCode
+		if !errors.As(err, &c) {
+			if c = cryptoErrors[err]; c == "" {
+				c = errInvalidInput
+			}
+		}
+		return []byte(resp + string(c))
+	}
+	return []byte(resp + "00" + fields)
+}
+
+// key returns the clear key of the key field encrypted under the LMK.
+func (s *Simulator) key(field string) ([]byte, error) {
+	enc, err := hex.DecodeString(field)
+	if err != nil || len(enc)%8 != 0 {
+		return nil, errKeyLength
+	}
+	return decryptECB(s.lmk, enc), nil
+}
+
+// lmkKeystream returns the digits the PINs of the account are masked with
+// under the LMK.
+func (s *Simulator) lmkKeystream(account string) string {
+	b, _ := hex.DecodeString("0000" + account)
+	enc := strings.ToUpper(hex.EncodeToString(encryptECB(s.lmk, b)))
+	return pincrypto.Decimalise(enc, "0123456789012345")
+}
+
+// encryptLMKPIN returns the PIN encrypted under the LMK: the PIN followed by
+// a 0 check digit, masked digit by digit with the keystream of the account.
+func (s *Simulator) encryptLMKPIN(pin, account string) string {
+	ks := s.lmkKeystream(account)
+	plain := pin + "0"
+	out := make([]byte, len(plain))
+	for i := range out {
+		out[i] = '0' + (plain[i]-'0'+ks[i]-'0')%10
+	}
+	return string(out)
+}
+
+// decryptLMKPIN returns the PIN encrypted under the LMK.
+func (s *Simulator) decryptLMKPIN(enc, account string) (string, error) {
+	if len(enc) < 5 || len(enc) > 13 || strings.Trim(enc, "0123456789") != "" {
+		return "", errLMKPIN
+	}
+	ks := s.lmkKeystream(account)
+	out := make([]byte, len(enc))
+	for i := range out {
+		out[i] = '0' + (enc[i]-ks[i]+10)%10
+	}
+	if out[len(out)-1] != '0' {
+		return "", errLMKPIN
+	}
+	return string(out[:len(out)-1]), nil
+}
+
+// reader reads the command fields. The first invalid field stops the
+// reading and is kept in err.
+type reader struct {
+	data []byte
+	err  error
+	// block is set once a PIN block is read, wide reads it as 32H
+	block bool
+	wide  bool
+}
+
+func (r *reader) fail(c errorCode) {
+	if r.err == nil {
+		r.err = c
+	}
+}
+
+func (r *reader) take(n int) string {
+	if r.err != nil {
+		return ""
+	}
+	if n < 0 || len(r.data) < n {
+		r.fail(errInvalidInput)
+		return ""
+	}
+	v := string(r.data[:n])
+	r.data = r.data[n:]
+	return v
+}
+
+// numeric reads n decimal digits.
+func (r *reader) numeric(n int) string {
+	v := r.take(n)
+	if strings.Trim(v, "0123456789") != "" {
+		r.fail(errInvalidInput)
+	}
+	return v
+}
+
+// number reads an n digit number.
+func (r *reader) number(n int) int {
+	v, total := r.numeric(n), 0
+	for i := 0; i < len(v); i++ {
+		total = total*10 + int(v[i]-'0')
+	}
+	return total
+}
+
+// hex reads n hexadecimal characters.
+func (r *reader) hex(n int) string {
+	v := r.take(n)
+	if strings.Trim(v, "0123456789ABCDEFabcdef") != "" {
+		r.fail(errInvalidInput)
+	}
+	return v
+}
+
+// key reads a key encrypted under the LMK and returns it without its scheme
+// tag: 16H, 'U' or 'X' + 32H, 'T' or 'Y' + 48H. Key blocks are not
+// supported.
+func (r *reader) key() string {
+	if r.err != nil || len(r.data) == 0 {
+		r.fail(errInvalidInput)
+		return ""
+	}
+	switch r.data[0] {
+	case 'U', 'X':
+		r.take(1)
+		return r.hex(32)
+	case 'T', 'Y':
+		r.take(1)
+		return r.hex(48)
+	case 'S':
+		r.fail(errKeyScheme)
+		return ""
+	}
+	return r.hex(16)
+}
+
+// pinBlock reads an encrypted PIN block, 16H or, if wide, 32H.
+func (r *reader) pinBlock() []byte {
+	r.block = true
+	n := 16
+	if r.wide {
+		n = 32
+	}
+	b, _ := hex.DecodeString(r.hex(n))
+	return b
+}
+
+// format reads a PIN block format code.
+func (r *reader) format() string {
+	v := r.numeric(2)
+	if r.err == nil && thales.BlockLength(v) == 0 {
+		r.fail(errFormat)
+	}
+	return v
+}
+
+// blockFormat reads the format code of the PIN block read last, which has
+// to match its length.
+func (r *reader) blockFormat() string {
+	v := r.format()
+	if r.err == nil && (v == thales.FormatISO4) != r.wide {
+		r.fail(errFormat)
+	}
+	return v
+}
+
+// account reads the account number of the format: 12N, or for ISO 4 the
+// PAN length and the PAN, of which the PAN is returned.
+func (r *reader) account(format string) string {
+	if format != thales.FormatISO4 {
+		return r.numeric(12)
+	}
+	n := r.number(2)
+	if r.err == nil && (n < 12 || n > 19) {
+		r.fail(errInvalidInput)
+	}
+	return r.numeric(n)
+}
+
+// rest reads the field of variable length followed by tail characters.
+func (r *reader) rest(tail int) string {
+	return r.take(len(r.data) - tail)
+}
+
+// end checks that the whole command was read.
+func (r *reader) end() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.fail(errInvalidInput)
+	}
+	return r.err
+}
+
+// accountNumber returns the 12 digit account number of the account number
+// field: the PAN of ISO 4 is reduced to its 12 rightmost digits excluding
+// the check digit.
+func accountNumber(account string) string {
+	if len(account) <= 12 {
+		return account
+	}
+	return account[len(account)-13 : len(account)-1]
+}
@@ -0,0 +1,329 @@
+//go:build !production
+
+package hsmsim_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/hsmsim"
+	"github.com/andrei-cloud/pinservice/pkg/service"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+// account is the account number field of service.PAN.
+const account = "407000000010"
+
+func newBroker(t *testing.T) hsmsim.Broker {
+	t.Helper()
+	sim, err := hsmsim.New(service.LMK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := hsmsim.NewBroker(&hsmsim.Server{Simulator: sim})
+	t.Cleanup(b.Close)
+	return b
+}
+
+func exec(t *testing.T, b broker.Broker, c thales.Command, r thales.Response) error {
+	t.Helper()
+	req, err := thales.Encode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.SendContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thales.Decode(c, resp, r)
+}
+
+func errorCode(err error) string {
+	var e *thales.Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+func TestPVV(t *testing.T) {
+	b := newBroker(t)
+
+	verify := thales.VerifyPVV{
+		Key:      service.TPK_ENC,
+		PVK:      service.PVK_ENC,
+		PINBlock: service.PINBlock,
+		Format:   thales.FormatISO0,
+		Account:  account,
+		PVKI:     "1",
+		PVV:      service.PVV,
+	}
+	if err := exec(t, b, verify, &thales.VerifyResponse{}); err != nil {
+		t.Fatalf("DC: %v", err)
+	}
+	verify.PVV = "3844"
+	if err := exec(t, b, verify, &thales.VerifyResponse{}); errorCode(err) != "01" {
+		t.Fatalf("DC with a wrong PVV: got %v, want error code 01", err)
+	}
+	verify.Interchange, verify.PVV = true, service.PVV
+	if err := exec(t, b, verify, &thales.VerifyResponse{}); err != nil {
+		t.Fatalf("EC: %v", err)
+	}
+
+	var pvv thales.PVVResponse
+	if err := exec(t, b, thales.GenerateCustomerPVV{
+		Key:      service.TPK_ENC,
+		PVK:      service.PVK_ENC,
+		PINBlock: service.PINBlock,
+		Format:   thales.FormatISO0,
+		Account:  account,
+		PVKI:     "1",
+	}, &pvv); err != nil || pvv.PVV != service.PVV {
+		t.Fatalf("FW: got %q, %v, want %s", pvv.PVV, err, service.PVV)
+	}
+
+	var lmkPIN thales.EncryptPINResponse
+	if err := exec(t, b, thales.EncryptPIN{PIN: service.ClearPIN, Account: account}, &lmkPIN); err != nil {
+		t.Fatalf("BA: %v", err)
+	}
+	if len(lmkPIN.PIN) != len(service.ClearPIN)+1 {
+		t.Fatalf("BA: got %q, want %d digits", lmkPIN.PIN, len(service.ClearPIN)+1)
+	}
+	pvv = thales.PVVResponse{}
+	if err := exec(t, b, thales.GeneratePVV{
+		PVK:     service.PVK_ENC,
+		PIN:     lmkPIN.PIN,
+		Account: account,
+		PVKI:    "1",
+	}, &pvv); err != nil || pvv.PVV != service.PVV {
+		t.Fatalf("DG: got %q, %v, want %s", pvv.PVV, err, service.PVV)
+	}
+}
+
+func TestTranslatePIN(t *testing.T) {
+	b := newBroker(t)
+	pan := "16" + service.PAN
+
+	for _, format := range []string{thales.FormatISO0, thales.FormatISO1, thales.FormatISO3, thales.FormatISO4} {
+		t.Run(format, func(t *testing.T) {
+			to := thales.TranslatePIN{
+				SourceKey:         service.TPK_ENC,
+				DestinationKey:    service.TPK_ENC,
+				MaxPINLength:      12,
+				PINBlock:          service.PINBlock,
+				SourceFormat:      thales.FormatISO0,
+				DestinationFormat: format,
+				Account:           account,
+			}
+			if format == thales.FormatISO4 {
+				to.Account = pan
+			}
+			var out thales.TranslatePINResponse
+			if err := exec(t, b, to, &out); err != nil {
+				t.Fatalf("CA: %v", err)
+			}
+			if out.PINLength != "04" || out.Format != format {
+				t.Fatalf("CA: got %+v", out)
+			}
+
+			back := thales.TranslatePIN{
+				Interchange:       true,
+				SourceKey:         service.TPK_ENC,
+				DestinationKey:    service.TPK_ENC,
+				MaxPINLength:      12,
+				PINBlock:          out.PINBlock,
+				SourceFormat:      format,
+				DestinationFormat: thales.FormatISO0,
+				Account:           to.Account,
+			}
+			var in thales.TranslatePINResponse
+			if err := exec(t, b, back, &in); err != nil {
+				t.Fatalf("CC: %v", err)
+			}
+			if in.PINBlock != service.PINBlock {
+				t.Fatalf("CC: got %s, want %s", in.PINBlock, service.PINBlock)
+			}
+
+			// the PVV verifies in the translated format as well
+			if format == thales.FormatISO1 {
+				return
+			}
+			if err := exec(t, b, thales.VerifyPVV{
+				Key:      service.TPK_ENC,
+				PVK:      service.PVK_ENC,
+				PINBlock: out.PINBlock,
+				Format:   format,
+				Account:  to.Account,
+				PVKI:     "1",
+				PVV:      service.PVV,
+			}, &thales.VerifyResponse{}); err != nil {
+				t.Fatalf("DC: %v", err)
+			}
+		})
+	}
+}
+
+func TestOffset(t *testing.T) {
+	b := newBroker(t)
+	params := thales.IBM{
+		CheckLength:         4,
+		Account:             account,
+		DecimalisationTable: service.DecimalisationTable,
+		ValidationData:      "1234567N9012",
+	}
+
+	var lmkPIN thales.EncryptPINResponse
+	if err := exec(t, b, thales.EncryptPIN{PIN: service.ClearPIN, Account: account}, &lmkPIN); err != nil {
+		t.Fatalf("BA: %v", err)
+	}
+	var offset thales.OffsetResponse
+	if err := exec(t, b, thales.GenerateOffset{PVK: service.PVK_ENC, PIN: lmkPIN.PIN, IBM: params}, &offset); err != nil {
+		t.Fatalf("DE: %v", err)
+	}
+	if len(offset.Offset) != len(service.ClearPIN) {
+		t.Fatalf("DE: got offset %q", offset.Offset)
+	}
+
+	var customer thales.OffsetResponse
+	if err := exec(t, b, thales.GenerateCustomerOffset{
+		Key:      service.TPK_ENC,
+		PVK:      service.PVK_ENC,
+		PINBlock: service.PINBlock,
+		Format:   thales.FormatISO0,
+		IBM:      params,
+	}, &customer); err != nil || customer.Offset != offset.Offset {
+		t.Fatalf("BK: got %q, %v, want %s", customer.Offset, err, offset.Offset)
+	}
+
+	verify := thales.VerifyOffset{
+		Key:          service.TPK_ENC,
+		PVK:          service.PVK_ENC,
+		MaxPINLength: 12,
+		PINBlock:     service.PINBlock,
+		Format:       thales.FormatISO0,
+		IBM:          params,
+		Offset:       offset.Offset,
+	}
+	if err := exec(t, b, verify, &thales.VerifyResponse{}); err != nil {
+		t.Fatalf("DA: %v", err)
+	}
+	wrong := []byte(offset.Offset)
+	wrong[0] = '0' + (wrong[0]-'0'+1)%10
+	verify.Offset = string(wrong)
+	if err := exec(t, b, verify, &thales.VerifyResponse{}); errorCode(err) != "01" {
+		t.Fatalf("DA with a wrong offset: got %v, want error code 01", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	b := newBroker(t)
+
+	var diag thales.DiagnosticsResponse
+	if err := exec(t, b, thales.Diagnostics{}, &diag); err != nil {
+		t.Fatalf("NC: %v", err)
+	}
+	if diag.Firmware != hsmsim.DefaultFirmware {
+		t.Fatalf("NC: got firmware %q", diag.Firmware)
+	}
+
+	// the check value of the TPK is in config/keys.json
+	resp, err := b.Send([]byte("BU001U" + service.TPK_ENC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(resp), "BV002CEBA9"; len(got) != 20 || got[:10] != want {
+		t.Fatalf("BU: got %q, want %s...", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	b := newBroker(t)
+
+	for _, tc := range []struct {
+		name string
+		req  string
+		want string
+	}{
+		{"unknown command", "ZY", "ZZ68"},
+		{"short command", "DC" + service.TPK_ENC, "DD15"},
+		{"key block", "BU001S1234", "BV26"},
+		{"key length flag", "BU000U" + service.TPK_ENC, "BV02"},
+		{"pin block format", "CAU" + service.TPK_ENC + "U" + service.TPK_ENC + "12" + service.PINBlock + "0201" + account, "CB23"},
+		{"pin under lmk", "DG" + service.PVK_ENC + "1234" + account + "1", "DH14"},
+		{"pin block", "DCU" + service.TPK_ENC + service.PVK_ENC + service.PINBlock + "01" + "000000000000" + "1" + service.PVV, "DD20"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := b.Send([]byte(tc.req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(resp) != tc.want {
+				t.Fatalf("got %q, want %q", resp, tc.want)
+			}
+		})
+	}
+}
+
+// TestServer speaks to the TCP server the way broker.Encode frames the
+// messages, header included.
+func TestServer(t *testing.T) {
+	sim, err := hsmsim.New(hsmsim.DefaultLMK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&hsmsim.Server{Simulator: sim}).Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for _, header := range []string{"0001", "00ZZ"} {
+		msg, err := broker.Encode([]byte(header + "NC"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := broker.Decode(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp[:8]) != header+"ND00" {
+			t.Fatalf("got %q, want header %s and ND00", resp, header)
+		}
+	}
+}
+
+func TestLoadScenario(t *testing.T) {
+	s, err := hsmsim.LoadScenario("../../config/hsmsim-faults.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Faults) != 6 || time.Duration(s.Faults[0].Latency) != 1500*time.Millisecond {
+		t.Fatalf("got %+v", s.Faults)
+	}
+
+	path := filepath.Join(t.TempDir(), "faults.json")
+	if err := os.WriteFile(path, []byte(`{"faults": [{"kind": "slow"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hsmsim.LoadScenario(path); err == nil {
+		t.Fatal("unknown fault kind loaded")
+	}
+}
@@ -0,0 +1,170 @@
+//go:build !production
+
+package hsmsim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	log "github.com/go-kit/log"
+)
+
+// Server serves the simulator on host connections. The messages are framed
+// and carry a header, which the responses echo, as with broker.Encode.
+type Server struct {
+	Simulator *Simulator
+	// Framer delimits the messages, broker.TwoByteLength if nil.
+	Framer broker.Framer
+	// HeaderLength is the length of the message header,
+	// broker.DefaultHeaderLength if zero.
+	HeaderLength int
+	// Scenario is the faults injected into the replies, none if nil.
+	Scenario *Scenario
+	Logger   log.Logger
+}
+
+// Serve accepts the connections of the listener and serves each of them
+// until the listener is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Dial returns the client end of an in-memory connection served by the
+// server. It is a pool.Factory of the broker.
+func (s *Server) Dial(context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return client, nil
+}
+
+// ServeConn answers the commands of the connection until it is closed or a
+// message can't be read. The replies are written in order, unless the
+// scenario delays some of them. The connection is closed on return.
+func (s *Server) ServeConn(conn net.Conn) error {
+	// the defaults apply to the copy, the server is shared by the connections
+	c := &serverConn{Server: *s, conn: conn}
+	if c.Framer == nil {
+		c.Framer = broker.TwoByteLength
+	}
+	if c.HeaderLength == 0 {
+		c.HeaderLength = broker.DefaultHeaderLength
+	}
+	if c.Logger == nil {
+		c.Logger = log.NewNopLogger()
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := c.Framer.ReadFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+				return nil
+			}
+			c.Logger.Log("remote", conn.RemoteAddr(), "err", err)
+			return err
+		}
+		if len(msg) < c.HeaderLength {
+			c.Logger.Log("remote", conn.RemoteAddr(), "err", "message shorter than its header")
+			return broker.ErrInvalidMsgLength
+		}
+		if err := c.reply(msg[:c.HeaderLength], msg[c.HeaderLength:]); err != nil {
+			return err
+		}
+	}
+}
+
+// serverConn is a connection of the server. Its writes are serialized, as
+// delayed replies are written concurrently.
+type serverConn struct {
+	Server
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// reply executes the command and writes the reply, with the fault of the
+// scenario that hits the command.
+func (c *serverConn) reply(header, cmd []byte) error {
+	resp := append(append([]byte{}, header...), c.Simulator.Handle(cmd)...)
+	f := c.Scenario.fault(cmd)
+
+	kind := "none"
+	if f != nil {
+		kind = f.Kind
+	}
+	c.Logger.Log("remote", c.conn.RemoteAddr(), "command", string(cmd[:min(2, len(cmd))]),
+		"response", string(resp[len(header):len(header)+4]), "fault", kind)
+
+	switch kind {
+	case FaultLatency:
+		time.AfterFunc(time.Duration(f.Latency), func() {
+			c.write(resp)
+		})
+		return nil
+	case FaultDrop:
+		return nil
+	case FaultTruncate:
+		n := f.Length
+		if n == 0 || n > len(resp) {
+			n = len(resp) / 2
+		}
+		resp = resp[:n]
+	case FaultWrongHeader:
+		// '#' is not a character of the task IDs of the broker
+		copy(resp, bytes.Repeat([]byte("#"), len(header)))
+	case FaultGarbage:
+		garbage := make([]byte, 16)
+		rand.Read(garbage)
+		if err := c.writeRaw(garbage); err != nil {
+			return err
+		}
+	case FaultDisconnect:
+		out, err := c.Framer.Frame(resp)
+		if err != nil {
+			return err
+		}
+		c.writeRaw(out[:len(out)/2])
+		return io.ErrUnexpectedEOF
+	}
+	return c.write(resp)
+}
+
+// write frames the message and writes it.
+func (c *serverConn) write(msg []byte) error {
+	out, err := c.Framer.Frame(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeRaw(out)
+}
+
+func (c *serverConn) writeRaw(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package hsmtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+var ErrNoCertificates = errors.New("no certificates found")
+
+// Config locates the TLS material of the connections to the HSM.
+type Config struct {
+	// CertFile and KeyFile hold the client certificate presented to the HSM
+	// for mutual TLS. They are optional.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the PEM bundle of the CAs trusted to sign the HSM
+	// certificate. The system roots are used if it is empty.
+	CAFile string
+	// ServerName is checked against the HSM certificate. The host of the
+	// dialled address is used if it is empty.
+	ServerName string
+}
+
+// Dialer dials TLS connections to the HSM. Its certificates are read from
+// the files of the Config and may be reloaded while connections are in
+// use; new connections use the reloaded certificates.
+type Dialer struct {
+	config Config
+	dialer net.Dialer
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	roots *x509.CertPool
+}
+
+// NewDialer returns a Dialer with the certificates of the config loaded.
+func NewDialer(c Config) (*Dialer, error) {
+	d := &Dialer{config: c}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload reads the certificates again. The certificates in use are kept if
+// any of them fails to load.
+func (d *Dialer) Reload() error {
+	var cert *tls.Certificate
+	if d.config.CertFile != "" || d.config.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(d.config.CertFile, d.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("client certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	var roots *x509.CertPool
+	if d.config.CAFile != "" {
+		pem, err := os.ReadFile(d.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("ca bundle: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("ca bundle %s: %w", d.config.CAFile, ErrNoCertificates)
+		}
+	}
+
+	d.mu.Lock()
+	d.cert, d.roots = cert, roots
+	d.mu.Unlock()
+	return nil
+}
+
+// DialContext connects to the HSM at the address and completes the TLS
+// handshake.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	serverName := d.config.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+	td := tls.Dialer{
+		NetDialer: &d.dialer,
+		Config:    d.tlsConfig(serverName),
+	}
+	return td.DialContext(ctx, network, addr)
+}
+
+// Dial connects to the HSM at the address and completes the TLS handshake.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// tlsConfig returns a config that takes the client certificate and the CAs
+// at handshake time, so that reloads apply to new connections. The built-in
+// verification is replaced by verify for the same reason.
+func (d *Dialer) tlsConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			d.mu.RLock()
+			defer d.mu.RUnlock()
+			if d.cert == nil {
+				// no certificate is sent
+				return &tls.Certificate{}, nil
+			}
+			return d.cert, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return d.verify(cs, serverName)
+		},
+	}
+}
+
+// verify checks the certificate chain of the HSM against the CAs and the
+// server name.
+func (d *Dialer) verify(cs tls.ConnectionState, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("hsm certificate: %w", ErrNoCertificates)
+	}
+	d.mu.RLock()
+	roots := d.roots
+	d.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
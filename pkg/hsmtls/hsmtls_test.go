@@ -0,0 +1,304 @@
+package hsmtls_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/hsmtls"
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+)
+
+const serverName = "hsm.local"
+
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authority{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns the PEM certificate and key signed by the authority.
+func (a *authority) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte) string {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// standIn starts a TLS HSM stand-in that requires a client certificate
+// signed by the client CA and answers NC diagnostics. It returns its
+// address.
+func standIn(t *testing.T, server, clientCA *authority) string {
+	t.Helper()
+	certPEM, keyPEM := server.issue(t, serverName, x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := broker.Decode(r)
+		if err != nil || len(req) < 6 {
+			return
+		}
+		header, command := req[:4], string(req[4:6])
+		resp := append([]byte{}, header...)
+		if command == "NC" {
+			resp = append(resp, "ND0026860271525484741500-0023"...)
+		} else {
+			resp = append(resp, command[0], command[1]+1)
+			resp = append(resp, "68"...)
+		}
+		out, err := broker.Encode(resp)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(...interface{}) error { return nil }
+
+// send sends NC to the HSM through a broker dialling with the dialer.
+func send(t *testing.T, d *hsmtls.Dialer, addr string) ([]byte, error) {
+	t.Helper()
+	p := pool.NewPool(1, func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", addr)
+	})
+	b := broker.NewBroker(p, 1, nopLogger{}, broker.WithTimeout(2*time.Second), broker.WithRetries(0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Start(ctx)
+	return b.Send([]byte("NC"))
+}
+
+type files struct {
+	cert, key, ca string
+}
+
+func clientFiles(t *testing.T, clientCA, serverCA *authority) files {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := clientCA.issue(t, "pinservice", x509.ExtKeyUsageClientAuth)
+	return files{
+		cert: writeFile(t, filepath.Join(dir, "client.crt"), certPEM),
+		key:  writeFile(t, filepath.Join(dir, "client.key"), keyPEM),
+		ca:   writeFile(t, filepath.Join(dir, "ca.crt"), serverCA.pem),
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	serverCA, clientCA := newAuthority(t, "hsm ca"), newAuthority(t, "client ca")
+	addr := standIn(t, serverCA, clientCA)
+	f := clientFiles(t, clientCA, serverCA)
+
+	d, err := hsmtls.NewDialer(hsmtls.Config{
+		CertFile:   f.cert,
+		KeyFile:    f.key,
+		CAFile:     f.ca,
+		ServerName: serverName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := send(t, d, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ND0026860271525484741500-0023"; string(resp) != want {
+		t.Errorf("response %q, want %q", resp, want)
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	serverCA, clientCA := newAuthority(t, "hsm ca"), newAuthority(t, "client ca")
+	otherCA := newAuthority(t, "other ca")
+	addr := standIn(t, serverCA, clientCA)
+
+	for _, tc := range []struct {
+		name   string
+		config func(files) hsmtls.Config
+		files  files
+	}{
+		{
+			name: "server name mismatch",
+			config: func(f files) hsmtls.Config {
+				return hsmtls.Config{CertFile: f.cert, KeyFile: f.key, CAFile: f.ca, ServerName: "other.local"}
+			},
+			files: clientFiles(t, clientCA, serverCA),
+		},
+		{
+			name: "untrusted hsm certificate",
+			config: func(f files) hsmtls.Config {
+				return hsmtls.Config{CertFile: f.cert, KeyFile: f.key, CAFile: f.ca, ServerName: serverName}
+			},
+			files: clientFiles(t, clientCA, otherCA),
+		},
+		{
+			name: "untrusted client certificate",
+			config: func(f files) hsmtls.Config {
+				return hsmtls.Config{CertFile: f.cert, KeyFile: f.key, CAFile: f.ca, ServerName: serverName}
+			},
+			files: clientFiles(t, otherCA, serverCA),
+		},
+		{
+			name: "no client certificate",
+			config: func(f files) hsmtls.Config {
+				return hsmtls.Config{CAFile: f.ca, ServerName: serverName}
+			},
+			files: clientFiles(t, clientCA, serverCA),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := hsmtls.NewDialer(tc.config(tc.files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := send(t, d, addr); err == nil {
+				t.Errorf("got response %q, want error", resp)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	serverCA, clientCA := newAuthority(t, "hsm ca"), newAuthority(t, "client ca")
+	addr := standIn(t, serverCA, clientCA)
+
+	// start with a client certificate the HSM does not trust
+	f := clientFiles(t, newAuthority(t, "old ca"), serverCA)
+	d, err := hsmtls.NewDialer(hsmtls.Config{
+		CertFile:   f.cert,
+		KeyFile:    f.key,
+		CAFile:     f.ca,
+		ServerName: serverName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(t, d, addr); err == nil {
+		t.Fatal("untrusted client certificate accepted")
+	}
+
+	certPEM, keyPEM := clientCA.issue(t, "pinservice", x509.ExtKeyUsageClientAuth)
+	writeFile(t, f.cert, certPEM)
+	writeFile(t, f.key, keyPEM)
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(t, d, addr); err != nil {
+		t.Fatalf("reloaded client certificate: %v", err)
+	}
+
+	// a broken file keeps the certificates in use
+	writeFile(t, f.ca, []byte("not a certificate"))
+	if err := d.Reload(); err == nil {
+		t.Fatal("broken ca bundle loaded")
+	}
+	if _, err := send(t, d, addr); err != nil {
+		t.Fatalf("certificates in use: %v", err)
+	}
+}
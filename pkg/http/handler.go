@@ -4,10 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/domain"
 	endpoint "github.com/andrei-cloud/pinservice/pkg/endpoint"
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
+	"github.com/andrei-cloud/pinservice/pkg/pool"
 	"github.com/andrei-cloud/pinservice/pkg/service"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
 	http1 "github.com/go-kit/kit/transport/http"
 	"github.com/google/uuid"
 )
@@ -21,7 +30,10 @@ func makeVerifyHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options [
 // JSON-encoded request from the HTTP request body.
 func decodeVerifyRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	req := endpoint.VerifyRequest{}
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := decodeJSON(r, &req)
+	if req.PIN == nil {
+		req.PIN = &domain.PIN{}
+	}
 	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
 		req.RequestId = uuid.New().String()
 	}
@@ -49,7 +61,13 @@ func makeGeneratePVVHandler(m *http.ServeMux, endpoints endpoint.Endpoints, opti
 // JSON-encoded request from the HTTP request body.
 func decodeGeneratePVVRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	req := endpoint.GeneratePVVRequest{}
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := decodeJSON(r, &req)
+	if req.PIN == nil {
+		req.PIN = &domain.PIN{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
 	return req, err
 }
 
@@ -64,11 +82,221 @@ func encodeGeneratePVVResponse(ctx context.Context, w http.ResponseWriter, respo
 	err = json.NewEncoder(w).Encode(response)
 	return
 }
+
+// makeGenerateOffsetHandler creates the handler logic
+func makeGenerateOffsetHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options []http1.ServerOption) {
+	m.Handle("/generate-offset", http1.NewServer(endpoints.GenerateOffsetEndpoint, decodeGenerateOffsetRequest, encodeGenerateOffsetResponse, options...))
+}
+
+// decodeGenerateOffsetRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded request from the HTTP request body.
+func decodeGenerateOffsetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.GenerateOffsetRequest{}
+	err := decodeJSON(r, &req)
+	if req.PIN == nil {
+		req.PIN = &domain.PIN{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
+	return req, err
+}
+
+// encodeGenerateOffsetResponse is a transport/http.EncodeResponseFunc that encodes
+// the response as JSON to the response writer
+func encodeGenerateOffsetResponse(ctx context.Context, w http.ResponseWriter, response interface{}) (err error) {
+	if f, ok := response.(endpoint.Failure); ok && f.Failed() != nil {
+		ErrorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(response)
+	return
+}
+
+// makeVerifyOffsetHandler creates the handler logic
+func makeVerifyOffsetHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options []http1.ServerOption) {
+	m.Handle("/verify-offset", http1.NewServer(endpoints.VerifyOffsetEndpoint, decodeVerifyOffsetRequest, encodeVerifyOffsetResponse, options...))
+}
+
+// decodeVerifyOffsetRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded request from the HTTP request body.
+func decodeVerifyOffsetRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.VerifyOffsetRequest{}
+	err := decodeJSON(r, &req)
+	if req.PIN == nil {
+		req.PIN = &domain.PIN{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
+	return req, err
+}
+
+// encodeVerifyOffsetResponse is a transport/http.EncodeResponseFunc that encodes
+// the response as JSON to the response writer
+func encodeVerifyOffsetResponse(ctx context.Context, w http.ResponseWriter, response interface{}) (err error) {
+	if f, ok := response.(endpoint.Failure); ok && f.Failed() != nil {
+		ErrorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(response)
+	return
+}
+
+// makeTranslatePINHandler creates the handler logic
+func makeTranslatePINHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options []http1.ServerOption) {
+	m.Handle("/translate", http1.NewServer(endpoints.TranslatePINEndpoint, decodeTranslatePINRequest, encodeTranslatePINResponse, options...))
+}
+
+// decodeTranslatePINRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded request from the HTTP request body.
+func decodeTranslatePINRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.TranslatePINRequest{}
+	err := decodeJSON(r, &req)
+	if req.Translation == nil {
+		req.Translation = &domain.Translation{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
+	return req, err
+}
+
+// encodeTranslatePINResponse is a transport/http.EncodeResponseFunc that encodes
+// the response as JSON to the response writer
+func encodeTranslatePINResponse(ctx context.Context, w http.ResponseWriter, response interface{}) (err error) {
+	if f, ok := response.(endpoint.Failure); ok && f.Failed() != nil {
+		ErrorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(response)
+	return
+}
+
+// makeVerifyComparisonHandler creates the handler logic
+func makeVerifyComparisonHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options []http1.ServerOption) {
+	m.Handle("/verify-comparison", http1.NewServer(endpoints.VerifyComparisonEndpoint, decodeVerifyComparisonRequest, encodeVerifyComparisonResponse, options...))
+}
+
+// decodeVerifyComparisonRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded request from the HTTP request body.
+func decodeVerifyComparisonRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.VerifyComparisonRequest{}
+	err := decodeJSON(r, &req)
+	if req.PIN == nil {
+		req.PIN = &domain.PIN{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
+	return req, err
+}
+
+// encodeVerifyComparisonResponse is a transport/http.EncodeResponseFunc that encodes
+// the response as JSON to the response writer
+func encodeVerifyComparisonResponse(ctx context.Context, w http.ResponseWriter, response interface{}) (err error) {
+	if f, ok := response.(endpoint.Failure); ok && f.Failed() != nil {
+		ErrorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(response)
+	return
+}
+
+// makeStorePINHandler creates the handler logic
+func makeStorePINHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options []http1.ServerOption) {
+	m.Handle("/store-pin", http1.NewServer(endpoints.StorePINEndpoint, decodeStorePINRequest, encodeStorePINResponse, options...))
+}
+
+// decodeStorePINRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded request from the HTTP request body.
+func decodeStorePINRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.StorePINRequest{}
+	err := decodeJSON(r, &req)
+	if req.PIN == nil {
+		req.PIN = &domain.PIN{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
+	return req, err
+}
+
+// encodeStorePINResponse is a transport/http.EncodeResponseFunc that encodes
+// the response as JSON to the response writer
+func encodeStorePINResponse(ctx context.Context, w http.ResponseWriter, response interface{}) (err error) {
+	if f, ok := response.(endpoint.Failure); ok && f.Failed() != nil {
+		ErrorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(response)
+	return
+}
+
+// makeChangePINHandler creates the handler logic
+func makeChangePINHandler(m *http.ServeMux, endpoints endpoint.Endpoints, options []http1.ServerOption) {
+	m.Handle("/change-pin", http1.NewServer(endpoints.ChangePINEndpoint, decodeChangePINRequest, encodeChangePINResponse, options...))
+}
+
+// decodeChangePINRequest is a transport/http.DecodeRequestFunc that decodes a
+// JSON-encoded request from the HTTP request body.
+func decodeChangePINRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.ChangePINRequest{}
+	err := decodeJSON(r, &req)
+	if req.PINChange == nil {
+		req.PINChange = &domain.PINChange{}
+	}
+	if req.RequestId = r.Header.Get("Request-ID"); req.RequestId == "" {
+		req.RequestId = uuid.New().String()
+	}
+	return req, err
+}
+
+// encodeChangePINResponse is a transport/http.EncodeResponseFunc that encodes
+// the response as JSON to the response writer
+func encodeChangePINResponse(ctx context.Context, w http.ResponseWriter, response interface{}) (err error) {
+	if f, ok := response.(endpoint.Failure); ok && f.Failed() != nil {
+		ErrorEncoder(ctx, f.Failed(), w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(response)
+	return
+}
 func ErrorEncoder(_ context.Context, err error, w http.ResponseWriter) {
+	status, code := err2code(err)
+	resp := errorWrapper{Success: false, Code: code, Error: err.Error()}
+	var hsmErr *service.HSMError
+	if errors.As(err, &hsmErr) {
+		resp.HSMCode = hsmErr.Code
+		resp.Retryable = hsmErr.Retryable
+	}
+	if code == CodeOverloaded {
+		resp.Retryable = true
+		w.Header().Set("Retry-After", RetryAfter)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(err2code(err))
-	json.NewEncoder(w).Encode(errorWrapper{Success: false, Error: err.Error()})
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
 }
+
+// ErrInvalidJSON is the error of a request body that is not the JSON of the
+// request.
+var ErrInvalidJSON = errors.New("invalid request body")
+
+// decodeJSON decodes the JSON request body into the request.
+func decodeJSON(r *http.Request, req interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	return nil
+}
+
 func ErrorDecoder(r *http.Response) error {
 	var w errorWrapper
 	if err := json.NewDecoder(r.Body).Decode(&w); err != nil {
@@ -77,16 +305,100 @@ func ErrorDecoder(r *http.Response) error {
 	return errors.New(w.Error)
 }
 
+// Machine-readable error codes of the error responses.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeKeyNotFound        = "key_not_found"
+	CodeBINNotFound        = "bin_not_found"
+	CodeUnsupportedMethod  = "unsupported_method"
+	CodeDeclined           = "pin_verification_failed"
+	CodePINPolicy          = "pin_policy_violation"
+	CodeHSMRejected        = "hsm_rejected_input"
+	CodeHSMUnavailable     = "hsm_unavailable"
+	CodeHSMError           = "hsm_error"
+	CodeHSMInvalidResponse = "hsm_invalid_response"
+	CodeHSMTimeout         = "hsm_timeout"
+	CodeOverloaded         = "overloaded"
+	CodeShuttingDown       = "shutting_down"
+	CodeCanceled           = "request_canceled"
+	CodeInternal           = "internal_error"
+)
+
+// StatusClientClosedRequest is the status of the requests canceled by the
+// client, as logged by nginx. The client is gone and does not read it.
+const StatusClientClosedRequest = 499
+
+// RetryAfter is the Retry-After header value, in seconds, of the responses
+// rejected because the HSMs are overloaded.
+var RetryAfter = "1"
+
 // This is used to set the http status, see an example here :
 // https://github.com/go-kit/kit/blob/master/examples/addsvc/pkg/addtransport/http.go#L133
-func err2code(err error) int {
-	if errors.Is(err, service.ErrHsmError) {
-		return http.StatusBadRequest
+func err2code(err error) (int, string) {
+	var hsmErr *service.HSMError
+	if errors.As(err, &hsmErr) {
+		switch {
+		case hsmErr.Decline:
+			return http.StatusUnprocessableEntity, CodeDeclined
+		case hsmErr.InvalidInput:
+			return http.StatusBadRequest, CodeHSMRejected
+		case hsmErr.Retryable:
+			return http.StatusServiceUnavailable, CodeHSMUnavailable
+		}
+		return http.StatusBadGateway, CodeHSMError
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrInvalidJSON),
+		errors.Is(err, service.ErrInvalidPIN),
+		errors.Is(err, service.ErrInvalidPAN),
+		errors.Is(err, thales.ErrInvalidField),
+		errors.Is(err, service.ErrInvalidKey),
+		errors.Is(err, service.ErrInvalidFormat),
+		errors.Is(err, service.ErrNoDecimalisation):
+		return http.StatusBadRequest, CodeInvalidRequest
+	case errors.Is(err, keystore.ErrKeyNotFound):
+		return http.StatusBadRequest, CodeKeyNotFound
+	case errors.Is(err, bintable.ErrNotFound):
+		return http.StatusBadRequest, CodeBINNotFound
+	case errors.Is(err, service.ErrPINPolicy):
+		return http.StatusUnprocessableEntity, CodePINPolicy
+	case errors.Is(err, service.ErrUnsupportedMethod):
+		return http.StatusNotImplemented, CodeUnsupportedMethod
+	case errors.Is(err, thales.ErrInvalidResponse):
+		return http.StatusBadGateway, CodeHSMInvalidResponse
+	case errors.Is(err, broker.ErrTimeout):
+		return http.StatusGatewayTimeout, CodeHSMTimeout
+	case errors.Is(err, broker.ErrOverloaded):
+		return http.StatusServiceUnavailable, CodeOverloaded
+	case errors.Is(err, broker.ErrShuttingDown):
+		return http.StatusServiceUnavailable, CodeShuttingDown
+	case errors.Is(err, broker.ErrNoTarget),
+		errors.Is(err, broker.ErrNoTaskID),
+		errors.Is(err, pool.ErrDialBackoff),
+		errors.Is(err, pool.ErrClosing),
+		errors.As(err, &netErr):
+		// no HSM connection to send the command on
+		return http.StatusServiceUnavailable, CodeHSMUnavailable
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.ErrClosedPipe),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, broker.ErrFrameTooLarge),
+		errors.Is(err, broker.ErrInvalidLRC):
+		// the HSM connection broke with the command in flight
+		return http.StatusServiceUnavailable, CodeHSMUnavailable
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest, CodeCanceled
 	}
-	return http.StatusInternalServerError
+	return http.StatusInternalServerError, CodeInternal
 }
 
 type errorWrapper struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error"`
+	Success   bool   `json:"success"`
+	Code      string `json:"code"`
+	HSMCode   string `json:"hsm_code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	Error     string `json:"error"`
 }
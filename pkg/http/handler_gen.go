@@ -13,5 +13,11 @@ func NewHTTPHandler(endpoints endpoint.Endpoints, options map[string][]http.Serv
 	m := http1.NewServeMux()
 	makeVerifyHandler(m, endpoints, options["Verify"])
 	makeGeneratePVVHandler(m, endpoints, options["GeneratePVV"])
+	makeGenerateOffsetHandler(m, endpoints, options["GenerateOffset"])
+	makeVerifyOffsetHandler(m, endpoints, options["VerifyOffset"])
+	makeTranslatePINHandler(m, endpoints, options["TranslatePIN"])
+	makeVerifyComparisonHandler(m, endpoints, options["VerifyComparison"])
+	makeStorePINHandler(m, endpoints, options["StorePIN"])
+	makeChangePINHandler(m, endpoints, options["ChangePIN"])
 	return m
 }
@@ -0,0 +1,74 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
+	"github.com/andrei-cloud/pinservice/pkg/pool"
+	"github.com/andrei-cloud/pinservice/pkg/service"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+func TestErr2Code(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrInvalidJSON, http.StatusBadRequest, CodeInvalidRequest},
+		{service.ErrInvalidPIN, http.StatusBadRequest, CodeInvalidRequest},
+		{fmt.Errorf("pan: %w", service.ErrInvalidPAN), http.StatusBadRequest, CodeInvalidRequest},
+		{thales.ErrInvalidField, http.StatusBadRequest, CodeInvalidRequest},
+		{service.ErrInvalidKey, http.StatusBadRequest, CodeInvalidRequest},
+		{service.ErrInvalidFormat, http.StatusBadRequest, CodeInvalidRequest},
+		{service.ErrNoDecimalisation, http.StatusBadRequest, CodeInvalidRequest},
+		{keystore.ErrKeyNotFound, http.StatusBadRequest, CodeKeyNotFound},
+		{bintable.ErrNotFound, http.StatusBadRequest, CodeBINNotFound},
+		{service.ErrPINPolicy, http.StatusUnprocessableEntity, CodePINPolicy},
+		{service.ErrUnsupportedMethod, http.StatusNotImplemented, CodeUnsupportedMethod},
+		{thales.ErrInvalidResponse, http.StatusBadGateway, CodeHSMInvalidResponse},
+		{broker.ErrTimeout, http.StatusGatewayTimeout, CodeHSMTimeout},
+		{broker.ErrOverloaded, http.StatusServiceUnavailable, CodeOverloaded},
+		{broker.ErrShuttingDown, http.StatusServiceUnavailable, CodeShuttingDown},
+		{broker.ErrNoTarget, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{broker.ErrNoTaskID, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{pool.ErrDialBackoff, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{pool.ErrClosing, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{dialErr, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{io.EOF, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{io.ErrUnexpectedEOF, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{io.ErrClosedPipe, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{net.ErrClosed, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{fmt.Errorf("%w: 70000 bytes, at most 65536", broker.ErrFrameTooLarge), http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{broker.ErrInvalidLRC, http.StatusServiceUnavailable, CodeHSMUnavailable},
+		{context.Canceled, StatusClientClosedRequest, CodeCanceled},
+		{errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+	} {
+		status, code := err2code(tc.err)
+		if status != tc.status || code != tc.code {
+			t.Errorf("%v: got %d %s, want %d %s", tc.err, status, code, tc.status, tc.code)
+		}
+	}
+}
+
+func TestDecodeInvalidJSON(t *testing.T) {
+	for _, body := range []string{"", "{", `{"pan": 4000}`, "[]"} {
+		r := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(body))
+		_, err := decodeVerifyRequest(context.Background(), r)
+		if status, code := err2code(err); status != http.StatusBadRequest || code != CodeInvalidRequest {
+			t.Errorf("%q: got %d %s (%v), want %d %s", body, status, code, err, http.StatusBadRequest, CodeInvalidRequest)
+		}
+	}
+}
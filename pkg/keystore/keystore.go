@@ -0,0 +1,135 @@
+package keystore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrInvalidKey  = errors.New("invalid key")
+)
+
+// Key types known to the service.
+const (
+	TypeTPK = "TPK"
+	TypeZPK = "ZPK"
+	TypePVK = "PVK"
+)
+
+var types = map[string]bool{
+	TypeTPK: true,
+	TypeZPK: true,
+	TypePVK: true,
+}
+
+// Key is a key encrypted under the LMK. Value holds the key as the HSM
+// expects it, including the key scheme tag, e.g. "U" for double length
+// variant keys.
+type Key struct {
+	Name       string `json:"name"`
+	Version    int    `json:"version"`
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	CheckValue string `json:"check_value,omitempty"`
+}
+
+// KeyStore resolves keys by their logical name and version. Version 0
+// resolves the latest version of the key.
+type KeyStore interface {
+	Key(ctx context.Context, name string, version int) (Key, error)
+}
+
+type memoryStore struct {
+	sync.RWMutex
+	keys map[string][]Key
+}
+
+// NewMemoryStore returns a KeyStore holding the given keys.
+func NewMemoryStore(keys ...Key) (*memoryStore, error) {
+	s := &memoryStore{}
+	if err := s.set(keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *memoryStore) Key(_ context.Context, name string, version int) (Key, error) {
+	s.RLock()
+	defer s.RUnlock()
+	versions, ok := s.keys[name]
+	if !ok || len(versions) == 0 {
+		return Key{}, fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	if version == 0 {
+		latest := versions[0]
+		for _, k := range versions[1:] {
+			if k.Version > latest.Version {
+				latest = k
+			}
+		}
+		return latest, nil
+	}
+	for _, k := range versions {
+		if k.Version == version {
+			return k, nil
+		}
+	}
+	return Key{}, fmt.Errorf("%s version %d: %w", name, version, ErrKeyNotFound)
+}
+
+func (s *memoryStore) set(keys []Key) error {
+	m := make(map[string][]Key, len(keys))
+	for _, k := range keys {
+		if k.Name == "" || k.Value == "" {
+			return fmt.Errorf("key %q: %w", k.Name, ErrInvalidKey)
+		}
+		if !types[k.Type] {
+			return fmt.Errorf("key %q: unknown type %q: %w", k.Name, k.Type, ErrInvalidKey)
+		}
+		for _, v := range m[k.Name] {
+			if v.Version == k.Version {
+				return fmt.Errorf("key %q version %d is duplicated: %w", k.Name, k.Version, ErrInvalidKey)
+			}
+		}
+		m[k.Name] = append(m[k.Name], k)
+	}
+	s.Lock()
+	s.keys = m
+	s.Unlock()
+	return nil
+}
+
+// FileStore is a KeyStore loaded from a JSON file holding the list of keys
+// encrypted under the LMK.
+type FileStore struct {
+	memoryStore
+	path string
+}
+
+// NewFileStore loads the keys from the file at path.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the key file again. The keys in use are kept if the file
+// can't be loaded.
+func (s *FileStore) Reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var keys []Key
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	return s.set(keys)
+}
@@ -0,0 +1,44 @@
+package keystore_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
+)
+
+func TestUnknownType(t *testing.T) {
+	if _, err := keystore.NewMemoryStore(keystore.Key{Name: "kek", Type: "KEK", Value: "U00"}); !errors.Is(err, keystore.ErrInvalidKey) {
+		t.Fatalf("memory store: got %v, want ErrInvalidKey", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	write := func(typ string) {
+		t.Helper()
+		data := `[{"name": "pvk", "version": 1, "type": "` + typ + `", "value": "U00"}]`
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("pvk")
+	if _, err := keystore.NewFileStore(path); !errors.Is(err, keystore.ErrInvalidKey) {
+		t.Fatalf("load: got %v, want ErrInvalidKey", err)
+	}
+
+	write(keystore.TypePVK)
+	keys, err := keystore.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("PVK2")
+	if err := keys.Reload(); !errors.Is(err, keystore.ErrInvalidKey) {
+		t.Fatalf("reload: got %v, want ErrInvalidKey", err)
+	}
+	if k, err := keys.Key(context.Background(), "pvk", 0); err != nil || k.Type != keystore.TypePVK {
+		t.Errorf("after the failed reload: got %+v, %v", k, err)
+	}
+}
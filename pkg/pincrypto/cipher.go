@@ -0,0 +1,77 @@
+//go:build !production
+
+package pincrypto
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// NewTDES returns the cipher of a single (8 bytes), double (16 bytes) or
+// triple (24 bytes) length DES key.
+func NewTDES(key []byte) (cipher.Block, error) {
+	switch len(key) {
+	case 8:
+		return des.NewCipher(key)
+	case 16:
+		k := make([]byte, 0, 24)
+		k = append(append(k, key...), key[:8]...)
+		return des.NewTripleDESCipher(k)
+	case 24:
+		return des.NewTripleDESCipher(key)
+	}
+	return nil, ErrKeyLength
+}
+
+// CheckValue returns the check value of the DES key: 8 zero bytes encrypted
+// under it, in hexadecimal. Its 6 leftmost digits are the usual KCV.
+func CheckValue(key []byte) (string, error) {
+	c, err := NewTDES(key)
+	if err != nil {
+		return "", err
+	}
+	return encodeHex(encryptECB(c, make([]byte, 8))), nil
+}
+
+func encryptECB(c cipher.Block, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i+c.BlockSize() <= len(data); i += c.BlockSize() {
+		c.Encrypt(out[i:], data[i:])
+	}
+	return out
+}
+
+func decryptECB(c cipher.Block, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i+c.BlockSize() <= len(data); i += c.BlockSize() {
+		c.Decrypt(out[i:], data[i:])
+	}
+	return out
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func encodeHex(b []byte) string {
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// randomHex returns n random hexadecimal digits taken from the alphabet.
+func randomHex(n int, alphabet string) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
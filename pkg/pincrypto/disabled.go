@@ -0,0 +1,36 @@
+//go:build production
+
+package pincrypto
+
+import "crypto/cipher"
+
+// The production build handles no clear keys: every operation fails with
+// ErrDisabled.
+
+func NewTDES(key []byte) (cipher.Block, error) {
+	return nil, ErrDisabled
+}
+
+func CheckValue(key []byte) (string, error) {
+	return "", ErrDisabled
+}
+
+func EncryptPINBlock(key []byte, pin, pan string, format Format) ([]byte, error) {
+	return nil, ErrDisabled
+}
+
+func DecryptPINBlock(key, block []byte, pan string, format Format) (string, error) {
+	return "", ErrDisabled
+}
+
+func PVV(pvk []byte, pan, pvki, pin string) (string, error) {
+	return "", ErrDisabled
+}
+
+func NaturalPIN(pvk []byte, validation, table string, n int) (string, error) {
+	return "", ErrDisabled
+}
+
+func IBMOffset(pvk []byte, pin, validation, table string) (string, error) {
+	return "", ErrDisabled
+}
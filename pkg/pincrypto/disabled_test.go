@@ -0,0 +1,23 @@
+//go:build production
+
+package pincrypto_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/pincrypto"
+)
+
+func TestDisabled(t *testing.T) {
+	key := make([]byte, 16)
+	if _, err := pincrypto.CheckValue(key); !errors.Is(err, pincrypto.ErrDisabled) {
+		t.Errorf("CheckValue: got %v, want ErrDisabled", err)
+	}
+	if _, err := pincrypto.EncryptPINBlock(key, "1234", "4234070000000102", pincrypto.ISO0); !errors.Is(err, pincrypto.ErrDisabled) {
+		t.Errorf("EncryptPINBlock: got %v, want ErrDisabled", err)
+	}
+	if _, err := pincrypto.PVV(key, "4234070000000102", "1", "1234"); !errors.Is(err, pincrypto.ErrDisabled) {
+		t.Errorf("PVV: got %v, want ErrDisabled", err)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !production
+
+package pincrypto
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// NaturalPIN returns the n digit IBM 3624 natural PIN: the validation data,
+// padded with F to 16 digits, is encrypted under the PVK and decimalised.
+func NaturalPIN(pvk []byte, validation, table string, n int) (string, error) {
+	if n < 4 || n > 12 {
+		return "", ErrPINLength
+	}
+	if len(validation) > 16 || strings.Trim(validation, "0123456789ABCDEFabcdef") != "" {
+		return "", ErrValidationData
+	}
+	if len(table) != 16 || !isDecimal(table) {
+		return "", ErrDecimalisation
+	}
+	c, err := NewTDES(pvk)
+	if err != nil {
+		return "", err
+	}
+	data, _ := hex.DecodeString(validation + strings.Repeat("F", 16-len(validation)))
+	return Decimalise(encodeHex(encryptECB(c, data)), table)[:n], nil
+}
+
+// IBMOffset returns the IBM 3624 offset of the PIN, as long as the PIN: its
+// digits minus those of the natural PIN, modulo 10.
+func IBMOffset(pvk []byte, pin, validation, table string) (string, error) {
+	if len(pin) < 4 || len(pin) > 12 || !isDecimal(pin) {
+		return "", ErrPINLength
+	}
+	natural, err := NaturalPIN(pvk, validation, table, len(pin))
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, len(pin))
+	for i := range out {
+		out[i] = '0' + (pin[i]-natural[i]+10)%10
+	}
+	return string(out), nil
+}
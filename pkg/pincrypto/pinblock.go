@@ -0,0 +1,161 @@
+//go:build !production
+
+package pincrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"strings"
+)
+
+// controls maps the formats to the control field of their PIN field.
+var controls = map[Format]byte{ISO0: '0', ISO1: '1', ISO2: '2', ISO3: '3', ISO4: '4'}
+
+// EncryptPINBlock returns the PIN block of the format encrypted under the
+// key. The PAN is not used by ISO 1 and ISO 2. ISO 4 blocks are encrypted
+// with AES, the others with TDES.
+func EncryptPINBlock(key []byte, pin, pan string, format Format) ([]byte, error) {
+	if len(pin) < 4 || len(pin) > 12 || !isDecimal(pin) {
+		return nil, ErrPINLength
+	}
+	if _, ok := controls[format]; !ok {
+		return nil, ErrFormat
+	}
+	panField, err := accountField(pan, format)
+	if err != nil {
+		return nil, err
+	}
+	field, _ := hex.DecodeString(pinField(pin, format))
+	if format != ISO4 {
+		c, err := NewTDES(key)
+		if err != nil {
+			return nil, err
+		}
+		return encryptECB(c, xor(field, panField)), nil
+	}
+
+	c, err := newAES(key)
+	if err != nil {
+		return nil, err
+	}
+	block := make([]byte, aes.BlockSize)
+	c.Encrypt(block, field)
+	c.Encrypt(block, xor(block, panField))
+	return block, nil
+}
+
+// DecryptPINBlock returns the PIN of the PIN block of the format encrypted
+// under the key.
+func DecryptPINBlock(key, block []byte, pan string, format Format) (string, error) {
+	if _, ok := controls[format]; !ok {
+		return "", ErrFormat
+	}
+	panField, err := accountField(pan, format)
+	if err != nil {
+		return "", err
+	}
+	var field []byte
+	if format != ISO4 {
+		c, err := NewTDES(key)
+		if err != nil {
+			return "", err
+		}
+		if len(block) != c.BlockSize() {
+			return "", ErrPINBlock
+		}
+		field = xor(decryptECB(c, block), panField)
+	} else {
+		c, err := newAES(key)
+		if err != nil {
+			return "", err
+		}
+		if len(block) != aes.BlockSize {
+			return "", ErrPINBlock
+		}
+		field = make([]byte, aes.BlockSize)
+		c.Decrypt(field, block)
+		c.Decrypt(field, xor(field, panField))
+	}
+	return parsePINField(encodeHex(field), format)
+}
+
+// pinField returns the clear PIN field of the format: the control field,
+// the PIN length, the PIN and the fill digits of the format.
+func pinField(pin string, format Format) string {
+	head := string(controls[format]) + string("0123456789ABC"[len(pin)]) + pin
+	switch format {
+	case ISO1:
+		return head + randomHex(14-len(pin), "0123456789ABCDEF")
+	case ISO3:
+		return head + randomHex(14-len(pin), "ABCDEF")
+	case ISO4:
+		return head + strings.Repeat("A", 14-len(pin)) + randomHex(16, "0123456789ABCDEF")
+	}
+	return head + strings.Repeat("F", 14-len(pin))
+}
+
+// parsePINField returns the PIN of the clear PIN field of the format.
+func parsePINField(field string, format Format) (string, error) {
+	n := hexValue(field[1])
+	if field[0] != controls[format] || n < 4 || n > 12 {
+		return "", ErrPINBlock
+	}
+	pin, fill := field[2:2+n], field[2+n:16]
+	if !isDecimal(pin) {
+		return "", ErrPINBlock
+	}
+	var valid string
+	switch format {
+	case ISO0, ISO2:
+		valid = "F"
+	case ISO3:
+		valid = "ABCDEF"
+	case ISO4:
+		valid = "A"
+	default:
+		return pin, nil
+	}
+	if strings.Trim(fill, valid) != "" {
+		return "", ErrPINBlock
+	}
+	return pin, nil
+}
+
+// accountField returns the account number field the PIN field is XORed
+// with: 4 zeros and the account number, or for ISO 4 the PAN length minus
+// 12, the PAN and zero padding. ISO 1 and ISO 2 have none.
+func accountField(pan string, format Format) ([]byte, error) {
+	var field string
+	switch format {
+	case ISO1, ISO2:
+		field = strings.Repeat("0", 16)
+	case ISO4:
+		if pan == "" || len(pan) > 19 || !isDecimal(pan) {
+			return nil, ErrPAN
+		}
+		if len(pan) < 12 {
+			pan = strings.Repeat("0", 12-len(pan)) + pan
+		}
+		field = string("01234567"[len(pan)-12]) + pan
+		field += strings.Repeat("0", 32-len(field))
+	default:
+		account, err := AccountNumber(pan)
+		if err != nil {
+			return nil, err
+		}
+		field = "0000" + account
+	}
+	b, _ := hex.DecodeString(field)
+	return b, nil
+}
+
+// newAES returns the cipher of an AES key. A double length TDES key is
+// used as an AES-128 key.
+func newAES(key []byte) (cipher.Block, error) {
+	switch len(key) {
+	case 16, 24, 32:
+		return aes.NewCipher(key)
+	}
+	return nil, ErrKeyLength
+}
@@ -0,0 +1,76 @@
+// Package pincrypto implements the PIN math of the HSM in software: ISO
+// 9564-1 PIN blocks, Visa PVVs, IBM 3624 offsets and key check values. It
+// is meant for tooling, simulators and test vectors, and works on clear
+// keys.
+//
+// Binaries built with the production tag get a stub that fails with
+// ErrDisabled, so that live clear keys can't be handled outside the HSM.
+package pincrypto
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrDisabled       = errors.New("pincrypto is disabled in production builds")
+	ErrKeyLength      = errors.New("invalid key length")
+	ErrPINLength      = errors.New("pin must be 4 to 12 digits")
+	ErrPINBlock       = errors.New("invalid pin block")
+	ErrPAN            = errors.New("invalid pan")
+	ErrFormat         = errors.New("unsupported pin block format")
+	ErrPVKI           = errors.New("pvki must be a single digit")
+	ErrValidationData = errors.New("validation data must be at most 16 hexadecimal digits")
+	ErrDecimalisation = errors.New("decimalisation table must be 16 decimal digits")
+)
+
+// Format is an ISO 9564-1 PIN block format.
+type Format int
+
+// PIN block formats.
+const (
+	ISO0 Format = iota // PIN XORed with the account number (ANSI X9.8)
+	ISO1               // PIN and random fill, no account number
+	ISO2               // PIN and F fill, no account number, for ICC
+	ISO3               // PIN and random A-F fill XORed with the account number
+	ISO4               // AES, PIN and PAN enciphered in two steps
+)
+
+// AccountNumber returns the 12 rightmost digits of the PAN excluding the
+// check digit, left padded with zeros if the PAN is shorter.
+func AccountNumber(pan string) (string, error) {
+	if len(pan) < 2 || len(pan) > 19 || !isDecimal(pan) {
+		return "", ErrPAN
+	}
+	account := pan[:len(pan)-1]
+	if len(account) < 12 {
+		return strings.Repeat("0", 12-len(account)) + account, nil
+	}
+	return account[len(account)-12:], nil
+}
+
+// Decimalise maps the hexadecimal digits through the decimalisation table,
+// 16 decimal digits indexed by the digit values.
+func Decimalise(digits, table string) string {
+	out := make([]byte, len(digits))
+	for i := 0; i < len(digits); i++ {
+		out[i] = table[hexValue(digits[i])]
+	}
+	return string(out)
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	}
+	return 0
+}
+
+func isDecimal(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
@@ -0,0 +1,141 @@
+//go:build !production
+
+package pincrypto_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/pincrypto"
+	"github.com/andrei-cloud/pinservice/pkg/service"
+)
+
+func key(t *testing.T, s string) []byte {
+	t.Helper()
+	k, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestCheckValue(t *testing.T) {
+	for _, tc := range []struct {
+		name, key, kcv string
+	}{
+		{"LMK", service.LMK, "F4EDC8"},
+		{"PVKA", service.PVKA, "3F8450"},
+		{"PVKB", service.PVKB, "7C2171"},
+		{"TPK", service.TPK, "2CEBA9"},
+	} {
+		got, err := pincrypto.CheckValue(key(t, tc.key))
+		if err != nil || got[:6] != tc.kcv {
+			t.Errorf("%s: got %q, %v, want %s", tc.name, got, err, tc.kcv)
+		}
+	}
+	if _, err := pincrypto.CheckValue(make([]byte, 10)); !errors.Is(err, pincrypto.ErrKeyLength) {
+		t.Errorf("10 byte key: got %v, want ErrKeyLength", err)
+	}
+}
+
+func TestPINBlock(t *testing.T) {
+	tpk := key(t, service.TPK)
+
+	block, err := pincrypto.EncryptPINBlock(tpk, service.ClearPIN, service.PAN, pincrypto.ISO0)
+	if err != nil || fmt.Sprintf("%X", block) != service.PINBlock {
+		t.Fatalf("ISO 0: got %X, %v, want %s", block, err, service.PINBlock)
+	}
+	pin, err := pincrypto.DecryptPINBlock(tpk, key(t, service.PINBlock), service.PAN, pincrypto.ISO0)
+	if err != nil || pin != service.ClearPIN {
+		t.Fatalf("ISO 0: got %q, %v, want %s", pin, err, service.ClearPIN)
+	}
+
+	for _, format := range []pincrypto.Format{pincrypto.ISO0, pincrypto.ISO1, pincrypto.ISO2, pincrypto.ISO3, pincrypto.ISO4} {
+		for _, pin := range []string{"1234", "987654", "012345678901"} {
+			block, err := pincrypto.EncryptPINBlock(tpk, pin, service.PAN, format)
+			if err != nil {
+				t.Fatalf("ISO %d %s: %v", format, pin, err)
+			}
+			got, err := pincrypto.DecryptPINBlock(tpk, block, service.PAN, format)
+			if err != nil || got != pin {
+				t.Errorf("ISO %d %s: got %q, %v", format, pin, got, err)
+			}
+			// the account number is bound to the block, but by ISO 1 and 2
+			got, err = pincrypto.DecryptPINBlock(tpk, block, "4235070000000102", format)
+			if bound := format != pincrypto.ISO1 && format != pincrypto.ISO2; bound == (err == nil && got == pin) {
+				t.Errorf("ISO %d %s with another PAN: got %q, %v", format, pin, got, err)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		pin    string
+		pan    string
+		format pincrypto.Format
+		want   error
+	}{
+		{"short PIN", "123", service.PAN, pincrypto.ISO0, pincrypto.ErrPINLength},
+		{"long PIN", "1234567890123", service.PAN, pincrypto.ISO0, pincrypto.ErrPINLength},
+		{"PIN not decimal", "12A4", service.PAN, pincrypto.ISO0, pincrypto.ErrPINLength},
+		{"PAN not decimal", "1234", "42340700000001O2", pincrypto.ISO3, pincrypto.ErrPAN},
+		{"long PAN", "1234", strings.Repeat("4", 20), pincrypto.ISO4, pincrypto.ErrPAN},
+		{"format", "1234", service.PAN, pincrypto.Format(5), pincrypto.ErrFormat},
+	} {
+		if _, err := pincrypto.EncryptPINBlock(tpk, tc.pin, tc.pan, tc.format); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if _, err := pincrypto.DecryptPINBlock(key(t, service.PVK), key(t, service.PINBlock), service.PAN, pincrypto.ISO0); !errors.Is(err, pincrypto.ErrPINBlock) {
+		t.Errorf("wrong key: got %v, want ErrPINBlock", err)
+	}
+}
+
+func TestPVV(t *testing.T) {
+	pvk := key(t, service.PVKA+service.PVKB)
+	got, err := pincrypto.PVV(pvk, service.PAN, "1", service.ClearPIN)
+	if err != nil || got != service.PVV {
+		t.Fatalf("got %q, %v, want %s", got, err, service.PVV)
+	}
+	// only the 4 leftmost PIN digits count
+	if got, _ := pincrypto.PVV(pvk, service.PAN, "1", service.ClearPIN+"56"); got != service.PVV {
+		t.Errorf("6 digit PIN: got %q, want %s", got, service.PVV)
+	}
+	if got, _ := pincrypto.PVV(pvk, service.PAN, "2", service.ClearPIN); got == service.PVV {
+		t.Errorf("PVKI 2: got %q", got)
+	}
+	if _, err := pincrypto.PVV(pvk, service.PAN, "12", service.ClearPIN); !errors.Is(err, pincrypto.ErrPVKI) {
+		t.Errorf("PVKI 12: got %v, want ErrPVKI", err)
+	}
+}
+
+func TestIBMOffset(t *testing.T) {
+	pvk := key(t, service.PVK)
+	account, err := pincrypto.AccountNumber(service.PAN)
+	if err != nil || account != "407000000010" {
+		t.Fatalf("AccountNumber: got %q, %v", account, err)
+	}
+
+	natural, err := pincrypto.NaturalPIN(pvk, account, service.DecimalisationTable, 4)
+	if err != nil || natural != "2185" {
+		t.Fatalf("NaturalPIN: got %q, %v, want 2185", natural, err)
+	}
+	offset, err := pincrypto.IBMOffset(pvk, service.ClearPIN, account, service.DecimalisationTable)
+	if err != nil || offset != "9159" {
+		t.Fatalf("IBMOffset: got %q, %v, want 9159", offset, err)
+	}
+	// the natural PIN is its own offset 0000
+	if offset, _ := pincrypto.IBMOffset(pvk, natural, account, service.DecimalisationTable); offset != "0000" {
+		t.Errorf("IBMOffset of the natural PIN: got %q, want 0000", offset)
+	}
+
+	if _, err := pincrypto.IBMOffset(pvk, service.ClearPIN, account, "012345678901234A"); !errors.Is(err, pincrypto.ErrDecimalisation) {
+		t.Errorf("decimalisation table: got %v, want ErrDecimalisation", err)
+	}
+	if _, err := pincrypto.IBMOffset(pvk, service.ClearPIN, account+"N", service.DecimalisationTable); !errors.Is(err, pincrypto.ErrValidationData) {
+		t.Errorf("validation data: got %v, want ErrValidationData", err)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !production
+
+package pincrypto
+
+import "encoding/hex"
+
+// PVV returns the Visa PVV of the PIN under the PVK pair, a double length
+// key. The transformed security parameter, the 11 rightmost digits of the
+// account number, the PVKI and the 4 leftmost PIN digits, is encrypted and
+// its digits are taken, the decimal ones first.
+func PVV(pvk []byte, pan, pvki, pin string) (string, error) {
+	if len(pin) < 4 || len(pin) > 12 || !isDecimal(pin) {
+		return "", ErrPINLength
+	}
+	if len(pvki) != 1 || !isDecimal(pvki) {
+		return "", ErrPVKI
+	}
+	account, err := AccountNumber(pan)
+	if err != nil {
+		return "", err
+	}
+	c, err := NewTDES(pvk)
+	if err != nil {
+		return "", err
+	}
+	tsp, _ := hex.DecodeString(account[1:] + pvki + pin[:4])
+	enc := encodeHex(encryptECB(c, tsp))
+
+	// the decimal digits first, then the others minus 10
+	var out []byte
+	for i := 0; i < len(enc) && len(out) < 4; i++ {
+		if enc[i] <= '9' {
+			out = append(out, enc[i])
+		}
+	}
+	for i := 0; i < len(enc) && len(out) < 4; i++ {
+		if enc[i] > '9' {
+			out = append(out, enc[i]-'A'+'0')
+		}
+	}
+	return string(out), nil
+}
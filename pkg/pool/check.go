@@ -0,0 +1,39 @@
+package pool
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrUnexpectedData = errors.New("unexpected data on idle connection")
+
+const checkTimeout = time.Millisecond
+
+// ConnCheck is a health check for idle connections that are not read while
+// they wait in the pool. It fails connections closed by the peer or that
+// hold unread data. Connections with a reader of their own, such as the
+// sessions of the HSM broker, must not use it. A live connection delays the
+// borrow by the check timeout.
+func ConnCheck(conn net.Conn) error {
+	// a short deadline fails the read of a live connection with nothing to
+	// read, after the check timeout
+	if err := conn.SetReadDeadline(time.Now().Add(checkTimeout)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	switch {
+	case n > 0:
+		return ErrUnexpectedData
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case err == nil:
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
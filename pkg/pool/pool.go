@@ -3,19 +3,25 @@ package pool
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
 var (
-	ErrClosing = errors.New("pool is closing")
+	ErrClosing     = errors.New("pool is closing")
+	ErrDialBackoff = errors.New("dial backoff")
 )
 
-type Pool interface {
-	Get() (PoolItem, error)
-	GetWithContext(context.Context) (PoolItem, error)
-	Release(PoolItem)
-	Put(PoolItem)
+// Pool hands out items of type T, e.g. net.Conn for the HSM connections.
+type Pool[T PoolItem] interface {
+	Get() (T, error)
+	GetWithContext(context.Context) (T, error)
+	Release(T)
+	Put(T)
+	TakeIdle(time.Duration) []T
 	Len() int
+	Stats() Stats
 	Close()
 }
 
@@ -23,102 +29,453 @@ type PoolItem interface {
 	Close() error
 }
 
-type Factory func() (PoolItem, error)
+// Factory creates an item. It should give up when the context is done.
+type Factory[T PoolItem] func(context.Context) (T, error)
 
-type pool struct {
+// Stats reports the items of the pool.
+type Stats struct {
+	InUse     int
+	Idle      int
+	Created   uint64
+	Destroyed uint64
+}
+
+// idleItem is an item waiting in the pool.
+type idleItem[T PoolItem] struct {
+	item  T
+	since time.Time
+	// taken is the last time the item was handed out by TakeIdle
+	taken time.Time
+}
+
+// touched returns the time the item was last returned or taken idle.
+func (it idleItem[T]) touched() time.Time {
+	if it.taken.After(it.since) {
+		return it.taken
+	}
+	return it.since
+}
+
+type pool[T PoolItem] struct {
 	sync.Mutex
-	cap, count  int
-	queue       chan PoolItem
-	factoryFunc Factory
+	config[T]
+	cap         int
+	factoryFunc Factory[T]
 	closing     bool
+
+	// idle items, the most recently returned last
+	idle []idleItem[T]
+	// creation time of the open items
+	born map[PoolItem]time.Time
+	// items handed out by TakeIdle, which keep their idle time when put back
+	taken map[PoolItem]idleItem[T]
+	// number of items being created
+	dialing int
+	// closed and replaced whenever an item is returned or its slot freed
+	notify chan struct{}
+	// done when the pool is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	created, destroyed uint64
+
+	// dial backoff
+	dialErr   error
+	dialFails int
+	nextDial  time.Time
+}
+
+type config[T PoolItem] struct {
+	healthCheck func(T) error
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	minIdle     int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	closeDelay  time.Duration
+}
+
+// Option configures a pool of items of type T.
+type Option[T PoolItem] func(*config[T])
+
+// WithHealthCheck sets the check run on an idle item before it is handed
+// out. Items failing the check are closed and another one is taken.
+func WithHealthCheck[T PoolItem](check func(T) error) Option[T] {
+	return func(c *config[T]) {
+		c.healthCheck = check
+	}
+}
+
+// WithIdleTimeout sets how long an item may wait in the pool before it is
+// closed. The default is no timeout.
+func WithIdleTimeout[T PoolItem](d time.Duration) Option[T] {
+	return func(c *config[T]) {
+		c.idleTimeout = d
+	}
+}
+
+// WithMaxLifetime sets how long an item is used after its creation. It is
+// closed when it is returned to or found in the pool after that. The
+// default is no limit.
+func WithMaxLifetime[T PoolItem](d time.Duration) Option[T] {
+	return func(c *config[T]) {
+		c.maxLifetime = d
+	}
+}
+
+// WithMinIdle sets the number of idle items the pool creates at startup and
+// keeps ready, within its capacity.
+func WithMinIdle[T PoolItem](n int) Option[T] {
+	return func(c *config[T]) {
+		c.minIdle = n
+	}
+}
+
+// WithDialBackoff sets the delays after a failed creation during which no
+// item is created, doubling from min up to max on consecutive failures.
+// The default is 100ms up to 10s.
+func WithDialBackoff[T PoolItem](min, max time.Duration) Option[T] {
+	return func(c *config[T]) {
+		c.minBackoff, c.maxBackoff = min, max
+	}
+}
+
+// WithCloseDelay delays closing the items evicted for their idle time or
+// lifetime, so that work still in progress on them, e.g. pipelined
+// commands, can complete. The default is to close them at once.
+func WithCloseDelay[T PoolItem](d time.Duration) Option[T] {
+	return func(c *config[T]) {
+		c.closeDelay = d
+	}
 }
 
-func NewPool(cap int, f Factory) *pool {
-	return &pool{
-		count:       0,
+func NewPool[T PoolItem](cap int, f Factory[T], opts ...Option[T]) *pool[T] {
+	p := &pool[T]{
+		config: config[T]{
+			minBackoff: 100 * time.Millisecond,
+			maxBackoff: 10 * time.Second,
+		},
 		cap:         cap,
-		queue:       make(chan PoolItem, cap),
 		factoryFunc: f,
+		born:        make(map[PoolItem]time.Time),
+		taken:       make(map[PoolItem]idleItem[T]),
+		notify:      make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(&p.config)
+	}
+	if p.idleTimeout > 0 || p.maxLifetime > 0 || p.minIdle > 0 {
+		go p.maintain()
 	}
+	return p
 }
 
-func (p *pool) Get() (item PoolItem, err error) {
-	if p.closing {
-		return nil, ErrClosing
-	}
-	if len(p.queue) == 0 && p.count < p.cap {
-		if item, err = p.factoryFunc(); err != nil {
-			return nil, err
-		}
+func (p *pool[T]) Get() (T, error) {
+	return p.GetWithContext(context.Background())
+}
 
-		p.queue <- item
+// GetWithContext hands out an idle item, or creates one if the pool has not
+// reached its capacity, or waits for an item to be returned until the
+// context is done.
+func (p *pool[T]) GetWithContext(ctx context.Context) (T, error) {
+	var zero T
+	for {
+		p.Lock()
+		if p.closing {
+			p.Unlock()
+			return zero, ErrClosing
+		}
 
-		{
-			p.Lock()
-			p.count++
+		if n := len(p.idle); n > 0 {
+			it := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			if p.expired(it, time.Now()) {
+				p.destroy(it.item)
+				p.Unlock()
+				p.closeLater(it.item)
+				continue
+			}
 			p.Unlock()
+			if p.healthCheck != nil {
+				if err := p.healthCheck(it.item); err != nil {
+					p.Release(it.item)
+					continue
+				}
+			}
+			return it.item, nil
+		}
+
+		// wake up at the end of the dial backoff as well
+		var retry <-chan time.Time
+		if len(p.born)+p.dialing < p.cap {
+			err := p.backoff(time.Now())
+			if err == nil {
+				p.dialing++
+				p.Unlock()
+				return p.create(ctx)
+			}
+			if len(p.born)+p.dialing == 0 {
+				// nothing to wait for
+				p.Unlock()
+				return zero, err
+			}
+			retry = time.After(time.Until(p.nextDial))
+		}
+
+		notify := p.notify
+		p.Unlock()
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-notify:
+		case <-retry:
 		}
 	}
-	return <-p.queue, nil
 }
 
-func (p *pool) GetWithContext(ctx context.Context) (item PoolItem, err error) {
+// create creates an item for a slot reserved by the caller.
+func (p *pool[T]) create(ctx context.Context) (T, error) {
+	var zero T
+	item, err := p.factoryFunc(ctx)
+
+	p.Lock()
+	defer p.Unlock()
+	p.dialing--
+	p.signal()
+	if err != nil {
+		p.dialFails++
+		p.dialErr = err
+		delay := p.minBackoff << (p.dialFails - 1)
+		if delay > p.maxBackoff || delay <= 0 {
+			delay = p.maxBackoff
+		}
+		p.nextDial = time.Now().Add(delay)
+		return zero, err
+	}
+	p.dialFails = 0
 	if p.closing {
-		return nil, ErrClosing
+		item.Close()
+		return zero, ErrClosing
 	}
-	if len(p.queue) == 0 && p.count < p.cap {
-		if item, err = p.factoryFunc(); err != nil {
-			return nil, err
-		}
+	p.born[item] = time.Now()
+	p.created++
+	return item, nil
+}
 
-		p.queue <- item
+// backoff returns an error while creations are held back after failures.
+func (p *pool[T]) backoff(now time.Time) error {
+	if p.dialFails == 0 || !now.Before(p.nextDial) {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrDialBackoff, p.dialErr)
+}
 
-		{
-			p.Lock()
-			p.count++
-			p.Unlock()
-		}
+// expired reports whether the idle item is past its idle timeout or
+// lifetime.
+func (p *pool[T]) expired(it idleItem[T], now time.Time) bool {
+	if p.idleTimeout > 0 && now.Sub(it.since) >= p.idleTimeout {
+		return true
+	}
+	return p.pastLifetime(it.item, now)
+}
+
+func (p *pool[T]) pastLifetime(item T, now time.Time) bool {
+	born, ok := p.born[item]
+	return p.maxLifetime > 0 && ok && now.Sub(born) >= p.maxLifetime
+}
+
+// destroy forgets the item. The caller closes it.
+func (p *pool[T]) destroy(item T) {
+	if _, ok := p.born[item]; !ok {
+		return
 	}
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case item = <-p.queue:
-		return item, nil
+	delete(p.born, item)
+	delete(p.taken, item)
+	p.destroyed++
+	p.signal()
+}
+
+// signal wakes up the callers waiting for an item.
+func (p *pool[T]) signal() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// closeLater closes the evicted item after the close delay.
+func (p *pool[T]) closeLater(item T) {
+	if p.closeDelay <= 0 {
+		item.Close()
+		return
 	}
+	time.AfterFunc(p.closeDelay, func() { item.Close() })
 }
 
-func (p *pool) Put(item PoolItem) {
+// Put returns the item to the pool. Items past their lifetime are closed.
+// An item taken by TakeIdle keeps its idle time, so that it is still closed
+// after the idle timeout.
+func (p *pool[T]) Put(item T) {
+	if PoolItem(item) == nil {
+		return
+	}
+	p.Lock()
 	if p.closing {
+		p.destroy(item)
+		p.Unlock()
 		item.Close()
-		{
-			p.Lock()
-			p.count--
-			p.Unlock()
-		}
+		return
+	}
+	if p.pastLifetime(item, time.Now()) {
+		p.destroy(item)
+		p.Unlock()
+		p.closeLater(item)
+		return
 	}
-	p.queue <- item
+	it := idleItem[T]{item: item, since: time.Now()}
+	if taken, ok := p.taken[item]; ok {
+		delete(p.taken, item)
+		it.since, it.taken = taken.since, it.since
+	}
+	p.idle = append(p.idle, it)
+	p.signal()
+	p.Unlock()
 }
 
-func (p *pool) Release(item PoolItem) {
-	if item != nil {
-		item.Close()
-		{
-			p.Lock()
-			p.count--
-			p.Unlock()
+// TakeIdle hands out the items that have been idle, and not taken, for at
+// least d, e.g. to probe them. The caller puts them back or releases them.
+// Taking an item does not count as using it.
+func (p *pool[T]) TakeIdle(d time.Duration) []T {
+	now := time.Now()
+	var taken []T
+
+	p.Lock()
+	defer p.Unlock()
+	idle := p.idle[:0]
+	for _, it := range p.idle {
+		if now.Sub(it.touched()) >= d {
+			taken = append(taken, it.item)
+			p.taken[it.item] = it
+			continue
 		}
+		idle = append(idle, it)
 	}
+	p.idle = idle
+	return taken
 }
 
-func (p *pool) Close() {
+// Release closes the item and frees its slot in the pool.
+func (p *pool[T]) Release(item T) {
+	if PoolItem(item) == nil {
+		return
+	}
 	p.Lock()
-	defer p.Unlock()
+	p.destroy(item)
+	p.Unlock()
+	item.Close()
+}
+
+// Close closes the idle items. The items in use are closed when they are
+// returned.
+func (p *pool[T]) Close() {
+	p.Lock()
+	if p.closing {
+		p.Unlock()
+		return
+	}
 	p.closing = true
-	for len(p.queue) > 0 {
-		item := <-p.queue
-		item.Close()
-		p.count--
+	p.cancel()
+	idle := p.idle
+	p.idle = nil
+	for _, it := range idle {
+		p.destroy(it.item)
+	}
+	p.signal()
+	p.Unlock()
+
+	for _, it := range idle {
+		it.item.Close()
+	}
+}
+
+// Len returns the number of open items.
+func (p *pool[T]) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.born)
+}
+
+func (p *pool[T]) Stats() Stats {
+	p.Lock()
+	defer p.Unlock()
+	return Stats{
+		InUse:     len(p.born) - len(p.idle),
+		Idle:      len(p.idle),
+		Created:   p.created,
+		Destroyed: p.destroyed,
+	}
+}
+
+// maintain evicts the expired idle items and keeps the minimum number of
+// idle items until the pool is closed.
+func (p *pool[T]) maintain() {
+	interval := time.Second
+	for _, d := range []time.Duration{p.idleTimeout / 2, p.maxLifetime / 2} {
+		if d > 0 && d < interval {
+			interval = d
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.evict()
+		p.warm()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func (p *pool) Len() int { return p.count }
+// evict closes the expired idle items.
+func (p *pool[T]) evict() {
+	now := time.Now()
+	var expired []T
+
+	p.Lock()
+	idle := p.idle[:0]
+	for _, it := range p.idle {
+		if p.expired(it, now) {
+			p.destroy(it.item)
+			expired = append(expired, it.item)
+			continue
+		}
+		idle = append(idle, it)
+	}
+	p.idle = idle
+	p.Unlock()
+
+	for _, item := range expired {
+		p.closeLater(item)
+	}
+}
+
+// warm creates idle items up to the minimum.
+func (p *pool[T]) warm() {
+	for {
+		p.Lock()
+		if p.closing || len(p.idle)+p.dialing >= p.minIdle || len(p.born)+p.dialing >= p.cap || p.backoff(time.Now()) != nil {
+			p.Unlock()
+			return
+		}
+		p.dialing++
+		p.Unlock()
+
+		item, err := p.create(p.ctx)
+		if err != nil {
+			return
+		}
+		p.Put(item)
+	}
+}
@@ -0,0 +1,345 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type item struct {
+	id     int
+	closed int32
+}
+
+func (i *item) Close() error {
+	atomic.StoreInt32(&i.closed, 1)
+	return nil
+}
+
+func (i *item) isClosed() bool { return atomic.LoadInt32(&i.closed) == 1 }
+
+// counter returns a factory of items numbered from 1.
+func counter() Factory[*item] {
+	var n int32
+	return func(context.Context) (*item, error) {
+		return &item{id: int(atomic.AddInt32(&n, 1))}, nil
+	}
+}
+
+func TestGetPut(t *testing.T) {
+	p := NewPool(2, counter())
+	defer p.Close()
+
+	a, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("same item handed out twice")
+	}
+
+	// the pool is exhausted
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetWithContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+
+	// a waiting caller gets the returned item
+	got := make(chan *item)
+	go func() {
+		i, _ := p.Get()
+		got <- i
+	}()
+	p.Put(a)
+	if i := <-got; i != a {
+		t.Errorf("got %v, want returned item %v", i, a)
+	}
+
+	want := Stats{InUse: 2, Idle: 0, Created: 2}
+	if s := p.Stats(); s != want {
+		t.Errorf("stats %+v, want %+v", s, want)
+	}
+
+	p.Release(b)
+	if !b.isClosed() {
+		t.Error("released item not closed")
+	}
+	want = Stats{InUse: 1, Idle: 0, Created: 2, Destroyed: 1}
+	if s := p.Stats(); s != want {
+		t.Errorf("stats %+v, want %+v", s, want)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	p := NewPool(2, counter(), WithHealthCheck(func(i *item) error {
+		if i.id == 1 {
+			return errors.New("dead")
+		}
+		return nil
+	}))
+	defer p.Close()
+
+	a, _ := p.Get()
+	p.Put(a)
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == a || !a.isClosed() {
+		t.Fatal("item failing the health check handed out")
+	}
+	if s := p.Stats(); s.Destroyed != 1 || s.Created != 2 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	p := NewPool(2, counter(), WithIdleTimeout[*item](20*time.Millisecond))
+	defer p.Close()
+
+	a, _ := p.Get()
+	p.Put(a)
+	time.Sleep(60 * time.Millisecond)
+	if !a.isClosed() {
+		t.Fatal("idle item not evicted")
+	}
+	if s := p.Stats(); s.Idle != 0 || s.Destroyed != 1 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	p := NewPool(1, counter(), WithMaxLifetime[*item](20*time.Millisecond))
+	defer p.Close()
+
+	a, _ := p.Get()
+	time.Sleep(30 * time.Millisecond)
+	p.Put(a)
+	if !a.isClosed() {
+		t.Fatal("item past its lifetime returned to the pool")
+	}
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == a {
+		t.Fatal("item past its lifetime handed out")
+	}
+}
+
+func TestCloseDelay(t *testing.T) {
+	p := NewPool(1, counter(), WithMaxLifetime[*item](10*time.Millisecond), WithCloseDelay[*item](50*time.Millisecond))
+	defer p.Close()
+
+	a, _ := p.Get()
+	time.Sleep(20 * time.Millisecond)
+	p.Put(a)
+	if a.isClosed() {
+		t.Fatal("evicted item closed before the delay")
+	}
+	time.Sleep(80 * time.Millisecond)
+	if !a.isClosed() {
+		t.Fatal("evicted item not closed after the delay")
+	}
+}
+
+func TestTakeIdle(t *testing.T) {
+	p := NewPool(2, counter())
+	defer p.Close()
+
+	a, _ := p.Get()
+	b, _ := p.Get()
+	p.Put(a)
+	time.Sleep(20 * time.Millisecond)
+	p.Put(b)
+
+	taken := p.TakeIdle(10 * time.Millisecond)
+	if len(taken) != 1 || taken[0] != a {
+		t.Fatalf("took %v, want the item idle for long", taken)
+	}
+	if s := p.Stats(); s.InUse != 1 || s.Idle != 1 {
+		t.Errorf("stats %+v", s)
+	}
+	p.Put(a)
+}
+
+func TestTakeIdleKeepsIdleTime(t *testing.T) {
+	p := NewPool(1, counter(), WithIdleTimeout[*item](60*time.Millisecond))
+	defer p.Close()
+
+	a, _ := p.Get()
+	p.Put(a)
+	// a keepalive probing the item every 10ms does not hold off its eviction
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for !a.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		for _, it := range p.TakeIdle(10 * time.Millisecond) {
+			if it != a {
+				t.Fatalf("took %v, want %v", it, a)
+			}
+			p.Put(it)
+		}
+	}
+	if !a.isClosed() {
+		t.Fatal("probed idle item not evicted")
+	}
+}
+
+func TestMinIdle(t *testing.T) {
+	p := NewPool(3, counter(), WithMinIdle[*item](2))
+	defer p.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Idle < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v, want 2 idle items", p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := p.Stats(); s.Created != 2 {
+		t.Errorf("stats %+v, want 2 created", s)
+	}
+}
+
+func TestDialBackoff(t *testing.T) {
+	var dials int32
+	dialErr := errors.New("connection refused")
+	p := NewPool(1, func(context.Context) (*item, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, dialErr
+	}, WithDialBackoff[*item](50*time.Millisecond, time.Second))
+	defer p.Close()
+
+	if _, err := p.Get(); !errors.Is(err, dialErr) {
+		t.Fatalf("got %v, want %v", err, dialErr)
+	}
+	if _, err := p.Get(); !errors.Is(err, ErrDialBackoff) {
+		t.Fatalf("got %v, want %v", err, ErrDialBackoff)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("%d dials during backoff, want 1", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := p.Get(); !errors.Is(err, dialErr) {
+		t.Fatalf("got %v, want %v", err, dialErr)
+	}
+}
+
+func TestFactoryContext(t *testing.T) {
+	p := NewPool(1, func(ctx context.Context) (*item, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetWithContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if n := p.Len(); n != 0 {
+		t.Errorf("%d items open after a cancelled dial", n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	p := NewPool(2, counter())
+	a, _ := p.Get()
+	b, _ := p.Get()
+	p.Put(a)
+
+	waiting := make(chan error)
+	go func() {
+		_, err := p.Get()
+		if err == nil {
+			_, err = p.Get()
+		}
+		waiting <- err
+	}()
+
+	p.Close()
+	if err := <-waiting; !errors.Is(err, ErrClosing) {
+		t.Fatalf("got %v, want %v", err, ErrClosing)
+	}
+	p.Put(b)
+	if !a.isClosed() || !b.isClosed() {
+		t.Error("items not closed")
+	}
+	if n := p.Len(); n != 0 {
+		t.Errorf("%d items open after close", n)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	p := NewPool(4, counter(), WithIdleTimeout[*item](time.Millisecond), WithMaxLifetime[*item](5*time.Millisecond), WithMinIdle[*item](1))
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				it, err := p.Get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if it.isClosed() {
+					t.Error("closed item handed out")
+				}
+				if (g+i)%7 == 0 {
+					p.Release(it)
+				} else {
+					p.Put(it)
+				}
+				p.Stats()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := p.Len(); n > 4 {
+		t.Errorf("%d items open, capacity is 4", n)
+	}
+}
+
+func TestConnCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+
+	if err := ConnCheck(conn); err != nil {
+		t.Fatalf("live connection: %v", err)
+	}
+
+	peer.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := ConnCheck(conn); err == nil {
+		t.Fatal("connection closed by the peer passed the check")
+	}
+}
@@ -1,10 +1,151 @@
 package service
 
-var HSMErrors = map[string]string{
-	"01": "pin verification failure: %w",
-	"10": "tpk parity error: %w",
-	"11": "pvk parity error: %w",
-	"27": "pvk not double length: %w",
-	"68": "command disabled: %w",
-	"69": "pin block format has been disabled: %w",
+import "fmt"
+
+// HSMError is an error code returned by the HSM.
+type HSMError struct {
+	// Command is the code of the command that failed.
+	Command     string
+	Code        string
+	Description string
+	// Retryable failures are transient and the command may be sent again.
+	Retryable bool
+	// Decline is a definite verification failure of the PIN.
+	Decline bool
+	// InvalidInput failures are caused by the data of the request.
+	InvalidInput bool
+}
+
+func (e *HSMError) Error() string {
+	return fmt.Sprintf("%s: hsm error %s: %s", e.Command, e.Code, e.Description)
+}
+
+// Unwrap makes every HSMError match ErrHsmError.
+func (e *HSMError) Unwrap() error { return ErrHsmError }
+
+type hsmErrorCode struct {
+	description  string
+	retryable    bool
+	invalidInput bool
+}
+
+// verificationCommands are the commands for which error code 01 is a
+// definite PIN verification failure.
+var verificationCommands = map[string]bool{
+	"BC": true,
+	"BE": true,
+	"DA": true,
+	"DC": true,
+	"EA": true,
+	"EC": true,
+}
+
+// hsmErrors is the payShield host command error code table.
+var hsmErrors = map[string]hsmErrorCode{
+	"01": {description: "verification failure or warning of imported key parity error"},
+	"02": {description: "key inappropriate length for algorithm", invalidInput: true},
+	"04": {description: "invalid key type code", invalidInput: true},
+	"05": {description: "invalid key length flag", invalidInput: true},
+	"10": {description: "source key parity error"},
+	"11": {description: "destination key parity error or key all zeros"},
+	"12": {description: "contents of user storage not available", retryable: true},
+	"13": {description: "invalid lmk identifier"},
+	"14": {description: "pin encrypted under lmk pair 02-03 is invalid", invalidInput: true},
+	"15": {description: "invalid input data", invalidInput: true},
+	"16": {description: "console or printer not ready or not connected", retryable: true},
+	"17": {description: "hsm not authorized, or operation prohibited by security settings"},
+	"18": {description: "document format definition not loaded"},
+	"19": {description: "specified diebold table is invalid"},
+	"20": {description: "pin block does not contain valid values", invalidInput: true},
+	"21": {description: "invalid index value, or index/block count would cause an overflow condition", invalidInput: true},
+	"22": {description: "invalid account number", invalidInput: true},
+	"23": {description: "invalid pin block format code", invalidInput: true},
+	"24": {description: "pin is fewer than 4 or more than 12 digits in length", invalidInput: true},
+	"25": {description: "decimalisation table error", invalidInput: true},
+	"26": {description: "invalid key scheme"},
+	"27": {description: "incompatible key length"},
+	"28": {description: "invalid key type"},
+	"29": {description: "key function not permitted"},
+	"30": {description: "invalid reference number", invalidInput: true},
+	"31": {description: "insufficient solicitation entries for batch", invalidInput: true},
+	"32": {description: "aes license not installed"},
+	"33": {description: "lmk key change storage is corrupted"},
+	"39": {description: "fraud detection"},
+	"40": {description: "invalid checksum", invalidInput: true},
+	"41": {description: "internal hardware/software error", retryable: true},
+	"42": {description: "des failure", retryable: true},
+	"43": {description: "rsa key generation failure", retryable: true},
+	"46": {description: "invalid tag for encrypted pin", invalidInput: true},
+	"47": {description: "algorithm not licensed"},
+	"49": {description: "private key error"},
+	"51": {description: "invalid message header"},
+	"65": {description: "transaction key scheme set to none"},
+	"67": {description: "command not licensed"},
+	"68": {description: "command has been disabled"},
+	"69": {description: "pin block format has been disabled"},
+	"74": {description: "invalid digest info syntax", invalidInput: true},
+	"75": {description: "single length key masquerading as double or triple length key"},
+	"76": {description: "rsa public key length error or rsa encrypted data length error", invalidInput: true},
+	"77": {description: "clear data block error", invalidInput: true},
+	"78": {description: "private key length error", invalidInput: true},
+	"79": {description: "hash algorithm object identifier error", invalidInput: true},
+	"80": {description: "data length error", invalidInput: true},
+	"81": {description: "invalid certificate header", invalidInput: true},
+	"82": {description: "invalid check value length", invalidInput: true},
+	"83": {description: "key block format error"},
+	"84": {description: "key block check value error"},
+	"85": {description: "invalid oaep mask generation function", invalidInput: true},
+	"86": {description: "invalid oaep mgf hash function", invalidInput: true},
+	"87": {description: "oaep parameter error", invalidInput: true},
+	"90": {description: "data parity error in the request message", retryable: true},
+	"91": {description: "lrc character does not match the value computed over the input data", retryable: true},
+	"92": {description: "count value is not between limits or is not correct", retryable: true},
+	"A1": {description: "incompatible lmk schemes"},
+	"A2": {description: "incompatible lmk identifiers"},
+	"A3": {description: "incompatible keyblock lmk identifiers"},
+	"A4": {description: "key block authentication failure"},
+	"A5": {description: "incompatible key length"},
+	"A6": {description: "invalid key usage"},
+	"A7": {description: "invalid algorithm"},
+	"A8": {description: "invalid mode of use"},
+	"A9": {description: "invalid key version number"},
+	"AA": {description: "invalid export field"},
+	"AB": {description: "invalid number of optional blocks"},
+	"AC": {description: "optional header block error"},
+	"AD": {description: "key status optional block error"},
+	"AE": {description: "invalid start date/time"},
+	"AF": {description: "invalid end date/time"},
+	"B0": {description: "invalid encryption mode"},
+	"B1": {description: "invalid authentication mode"},
+	"B2": {description: "miscellaneous keyblock error"},
+	"B3": {description: "invalid number of optional blocks"},
+	"B4": {description: "optional block data error"},
+	"B5": {description: "incompatible components"},
+	"B6": {description: "incompatible key status optional blocks"},
+	"B7": {description: "invalid change field"},
+	"B8": {description: "invalid old value"},
+	"B9": {description: "invalid new value"},
+	"BA": {description: "no key status block in the keyblock"},
+	"BB": {description: "invalid wrapping key"},
+	"BC": {description: "repeated optional block"},
+	"BD": {description: "incompatible key types"},
+	"BE": {description: "invalid keyblock header id"},
+}
+
+// NewHSMError returns the HSMError of the error code returned to the command.
+func NewHSMError(command, code string) *HSMError {
+	e := &HSMError{Command: command, Code: code}
+	c, ok := hsmErrors[code]
+	if !ok {
+		e.Description = "unknown error code"
+		return e
+	}
+	e.Description = c.description
+	e.Retryable = c.retryable
+	e.InvalidInput = c.invalidInput
+	if code == "01" && verificationCommands[command] {
+		e.Description = "pin verification failure"
+		e.Decline = true
+	}
+	return e
 }
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrei-cloud/pinservice/pkg/domain"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+// pinBlockFormats maps the format codes and their aliases to the codes
+// sent to the HSM.
+var pinBlockFormats = map[string]string{
+	thales.FormatISO0: thales.FormatISO0,
+	thales.FormatISO1: thales.FormatISO1,
+	thales.FormatISO3: thales.FormatISO3,
+	thales.FormatISO4: thales.FormatISO4,
+	"ISO0":            thales.FormatISO0,
+	"ISO1":            thales.FormatISO1,
+	"ISO3":            thales.FormatISO3,
+	"ISO4":            thales.FormatISO4,
+}
+
+// formatCode returns the HSM code of the PIN block format, defaulting to
+// ISO 9564-1 format 0.
+func formatCode(format string) (string, error) {
+	if format == "" {
+		return thales.FormatISO0, nil
+	}
+	code, ok := pinBlockFormats[strings.ToUpper(strings.ReplaceAll(format, "-", ""))]
+	if !ok {
+		return "", ErrInvalidFormat
+	}
+	return code, nil
+}
+
+// accountNumber returns the account number field for the PIN block format:
+//   - ISO 0 and ISO 3: the 12 rightmost digits of the PAN excluding the check digit;
+//   - ISO 1: the PAN is not part of the PIN block, so it may be omitted;
+//   - ISO 4: the full PAN prefixed with its 2 digit length.
+func accountNumber(pan, format string) (string, error) {
+	if strings.Trim(pan, "0123456789") != "" {
+		return "", ErrInvalidPAN
+	}
+	switch format {
+	case thales.FormatISO1:
+		if pan == "" {
+			return strings.Repeat("0", 12), nil
+		}
+	case thales.FormatISO4:
+		if len(pan) < 12 || len(pan) > 19 {
+			return "", ErrInvalidPAN
+		}
+		return fmt.Sprintf("%02d%s", len(pan), pan), nil
+	}
+	if len(pan) < 13 {
+		return "", ErrInvalidPAN
+	}
+	return pan[len(pan)-13 : len(pan)-1], nil
+}
+
+// translationAccount returns the account number field of a translation: the
+// ISO 4 field is used if either side is ISO 4, and the PAN may only be
+// omitted when both sides are ISO 1.
+func translationAccount(pan, srcFormat, dstFormat string) (string, error) {
+	switch {
+	case srcFormat == thales.FormatISO4 || dstFormat == thales.FormatISO4:
+		return accountNumber(pan, thales.FormatISO4)
+	case srcFormat == thales.FormatISO1 && dstFormat == thales.FormatISO1:
+		return accountNumber(pan, thales.FormatISO1)
+	}
+	return accountNumber(pan, thales.FormatISO0)
+}
+
+// encryptedPIN returns the PIN block of the request along with its format
+// code and the account number field for the format.
+func encryptedPIN(pin *domain.PIN) (block, format, account string, err error) {
+	if format, err = formatCode(pin.Format); err != nil {
+		return
+	}
+	if account, err = accountNumber(pin.PAN, format); err != nil {
+		return
+	}
+	return pin.EncryptedPIN, format, account, nil
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/andrei-cloud/pinservice/pkg/domain"
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
+)
+
+// key resolves the key reference in the key store and checks that the key
+// is one of the given types.
+func (b *basicPinService) key(ctx context.Context, ref domain.KeyRef, types ...string) (keystore.Key, error) {
+	if b.keys == nil {
+		return keystore.Key{}, fmt.Errorf("key store not initialized")
+	}
+	if ref.Name == "" {
+		return keystore.Key{}, fmt.Errorf("key name is empty: %w", ErrInvalidKey)
+	}
+
+	k, err := b.keys.Key(ctx, ref.Name, ref.Version)
+	if err != nil {
+		return keystore.Key{}, err
+	}
+	if !contains(types, k.Type) {
+		return keystore.Key{}, fmt.Errorf("%s is %s, expected %s: %w", k.Name, k.Type, strings.Join(types, " or "), ErrInvalidKey)
+	}
+	return k, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
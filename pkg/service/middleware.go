@@ -2,6 +2,8 @@ package service
 
 import (
 	"context"
+	"errors"
+	"strings"
 
 	"github.com/andrei-cloud/pinservice/pkg/domain"
 	log "github.com/go-kit/log"
@@ -33,7 +35,76 @@ func (l loggingMiddleware) Verify(ctx context.Context, pin *domain.PIN) (e0 erro
 
 func (l loggingMiddleware) GeneratePVV(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
 	defer func() {
-		l.logger.Log("method", "GeneratePVV", "request", pin, "s0", s0, "e1", e1)
+		l.logger.Log("method", "GeneratePVV", "request", pin.RequestId, "err", e1)
 	}()
 	return l.next.GeneratePVV(ctx, pin)
 }
+
+func (l loggingMiddleware) GenerateOffset(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	defer func() {
+		l.logger.Log("method", "GenerateOffset", "request", pin.RequestId, "err", e1)
+	}()
+	return l.next.GenerateOffset(ctx, pin)
+}
+
+func (l loggingMiddleware) VerifyOffset(ctx context.Context, pin *domain.PIN) (e0 error) {
+	defer func() {
+		l.logger.Log("method", "VerifyOffset", "request", pin.RequestId, "err", e0)
+	}()
+	return l.next.VerifyOffset(ctx, pin)
+}
+
+func (l loggingMiddleware) TranslatePIN(ctx context.Context, t *domain.Translation) (s0 string, e1 error) {
+	defer func() {
+		l.logger.Log("method", "TranslatePIN", "request", t.RequestId, "err", e1)
+	}()
+	return l.next.TranslatePIN(ctx, t)
+}
+
+func (l loggingMiddleware) VerifyComparison(ctx context.Context, pin *domain.PIN) (e0 error) {
+	defer func() {
+		l.logger.Log("method", "VerifyComparison", "request", pin.RequestId, "err", e0)
+	}()
+	return l.next.VerifyComparison(ctx, pin)
+}
+
+func (l loggingMiddleware) StorePIN(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	defer func() {
+		l.logger.Log("method", "StorePIN", "request", pin.RequestId, "err", e1)
+	}()
+	return l.next.StorePIN(ctx, pin)
+}
+
+// ChangePIN logs the PIN change as an audit event, with the masked PAN and
+// the outcome of the change.
+func (l loggingMiddleware) ChangePIN(ctx context.Context, c *domain.PINChange) (p0 *domain.PIN, e1 error) {
+	defer func() {
+		l.logger.Log("method", "ChangePIN", "request", c.RequestId, "audit", "pin_change",
+			"pan", maskPAN(c.PAN), "outcome", changeOutcome(e1), "err", e1)
+	}()
+	return l.next.ChangePIN(ctx, c)
+}
+
+// changeOutcome returns the outcome of a PIN change: changed, declined if
+// the PIN failed verification, rejected if the new PIN broke the PIN
+// policy, or failed.
+func changeOutcome(err error) string {
+	var hsmErr *HSMError
+	switch {
+	case err == nil:
+		return "changed"
+	case errors.As(err, &hsmErr) && hsmErr.Decline:
+		return "declined"
+	case errors.Is(err, ErrPINPolicy):
+		return "rejected"
+	}
+	return "failed"
+}
+
+// maskPAN keeps the BIN and the 4 last digits of the PAN.
+func maskPAN(pan string) string {
+	if len(pan) < 11 {
+		return strings.Repeat("*", len(pan))
+	}
+	return pan[:6] + strings.Repeat("*", len(pan)-10) + pan[len(pan)-4:]
+}
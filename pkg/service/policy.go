@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/domain"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
+)
+
+// checkPINPolicy checks the new PIN block of a PIN change against the PIN
+// policy: its length is within the PIN lengths of the BIN range, and it is
+// neither the old PIN nor one of the first weak PINs of the range. The PINs
+// are compared encrypted under the LMK, which is deterministic for an
+// account, so the new PIN under LMK is returned for reuse. It costs two JC
+// commands and a BA command per weak PIN checked.
+func (b *basicPinService) checkPINPolicy(ctx context.Context, hsm broker.Broker, r bintable.Range, old, pin *domain.PIN) (string, error) {
+	lmkPIN, err := b.storePIN(ctx, hsm, pin)
+	if err != nil {
+		return "", err
+	}
+	// the PIN under LMK is one character longer than the PIN
+	length := len(lmkPIN) - 1
+	if length < r.MinPINLength || length > r.MaxPINLength {
+		return "", fmt.Errorf("pin length %d is not %d-%d: %w", length, r.MinPINLength, r.MaxPINLength, ErrPINPolicy)
+	}
+
+	oldLMKPIN, err := b.storePIN(ctx, hsm, old)
+	if err != nil {
+		return "", err
+	}
+	if oldLMKPIN == lmkPIN {
+		return "", fmt.Errorf("new pin is the old pin: %w", ErrPINPolicy)
+	}
+
+	account, err := accountNumber(pin.PAN, thales.FormatISO0)
+	if err != nil {
+		return "", err
+	}
+	weak := weakPINs(length)
+	switch n := r.WeakPINChecks; {
+	case n < 0:
+		weak = nil
+	case n < len(weak):
+		weak = weak[:n]
+	}
+	for _, pin := range weak {
+		response := thales.EncryptPINResponse{}
+		if err := exec(ctx, hsm, thales.EncryptPIN{PIN: pin, Account: account}, &response); err != nil {
+			return "", err
+		}
+		if response.PIN == lmkPIN {
+			return "", fmt.Errorf("weak pin: %w", ErrPINPolicy)
+		}
+	}
+	return lmkPIN, nil
+}
+
+// weakPINs returns the PINs of the length that may not be chosen, the most
+// common first: a run of ascending digits from 1, a digit repeated, then the
+// other runs of ascending or descending digits.
+func weakPINs(length int) []string {
+	const ascending, descending = "0123456789", "9876543210"
+	pins := make([]string, 0, 10+2*(11-length))
+	if 1+length <= 10 {
+		pins = append(pins, ascending[1:1+length])
+	}
+	for d := '0'; d <= '9'; d++ {
+		pins = append(pins, strings.Repeat(string(d), length))
+	}
+	for i := 0; i+length <= 10; i++ {
+		if i != 1 {
+			pins = append(pins, ascending[i:i+length])
+		}
+		pins = append(pins, descending[i:i+length])
+	}
+	return pins
+}
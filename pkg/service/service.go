@@ -1,100 +1,588 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
 	"github.com/andrei-cloud/pinservice/pkg/broker"
 	"github.com/andrei-cloud/pinservice/pkg/domain"
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
+	"github.com/andrei-cloud/pinservice/pkg/thales"
 )
 
 //below block is used for developmentand testing purposes ONLY
 const (
 	LMK = "DFAEBFECEAFBEFDFAEBFECEAFBEFDFAE" //F4EDC8
 	//clear keys
-	PVKA = "8D9341F9E728F3DD" //47F249
-	PVKB = "9CD1C3BE18DBE869" //49A471
+	PVKA = "8D9341F9E728F3DD" //3F8450
+	PVKB = "9CD1C3BE18DBE869" //7C2171
 	PVK  = "8D9341F9E728F3DD9CD1C3BE18DBE869"
-	TPK  = "FA9F90D49CB27B7D14A3FA9CCCFF6CB7" //804288
-	//keys under LMK
+	TPK  = "FA9F90D49CB27B7D14A3FA9CCCFF6CB7" //2CEBA9
+	//keys under LMK, see config/keys.json
 	PVK_ENC = "7336D50C47128D710DF450BCB2C6461B"
 	TPK_ENC = "C4ED597EE0C9697104ED399BE6F8B872"
 
 	PINBlock = "793AE62DFC8D2426"
 
 	ClearPIN = "1234"
-	PVV      = "3843"
+	PVV      = "9600"
 	PAN      = "4234070000000102"
+
+	DecimalisationTable = "0123456789012345"
 )
 
 var (
-	ErrInvalidPIN      = errors.New("invalid pin")
-	ErrInvalidResponse = errors.New("response is not valid")
-	ErrHsmError        = errors.New("hsm error")
+	ErrInvalidPIN        = errors.New("invalid pin")
+	ErrInvalidPAN        = errors.New("invalid pan")
+	ErrInvalidKey        = errors.New("invalid key")
+	ErrInvalidFormat     = errors.New("invalid pin block format")
+	ErrUnsupportedMethod = errors.New("unsupported pin verification method")
+	ErrInvalidResponse   = thales.ErrInvalidResponse
+	ErrHsmError          = errors.New("hsm error")
+	ErrPINPolicy         = errors.New("pin does not meet the pin policy")
+	ErrNoDecimalisation  = errors.New("decimalisation table is missing")
 )
 
 // PinService describes the service.
 type PinService interface {
 	Verify(ctx context.Context, pin *domain.PIN) error
 	GeneratePVV(ctx context.Context, pin *domain.PIN) (string, error)
+	GenerateOffset(ctx context.Context, pin *domain.PIN) (string, error)
+	VerifyOffset(ctx context.Context, pin *domain.PIN) error
+	TranslatePIN(ctx context.Context, t *domain.Translation) (string, error)
+	VerifyComparison(ctx context.Context, pin *domain.PIN) error
+	StorePIN(ctx context.Context, pin *domain.PIN) (string, error)
+	ChangePIN(ctx context.Context, c *domain.PINChange) (*domain.PIN, error)
 }
 
 var _ PinService = &basicPinService{}
 
+// DefaultPool is the HSM pool of the BIN ranges that don't name one.
+const DefaultPool = "default"
+
+// Brokers maps the HSM pool names of the BIN table to their brokers.
+type Brokers map[string]broker.Broker
+
+// Pools returns the names of the HSM pools in order.
+func (b Brokers) Pools() []string {
+	pools := make([]string, 0, len(b))
+	for name := range b {
+		pools = append(pools, name)
+	}
+	sort.Strings(pools)
+	return pools
+}
+
 type basicPinService struct {
-	hsmBroker broker.Broker
+	brokers Brokers
+	keys    keystore.KeyStore
+	bins    bintable.Table
 }
 
+// Verify verifies the PIN block with the method of the request, or else
+// with the method of the BIN range of the PAN.
 func (b *basicPinService) Verify(ctx context.Context, pin *domain.PIN) (e0 error) {
-	var response []byte
+	r, hsm, e0 := b.route(pin.PAN)
+	if e0 != nil {
+		return e0
+	}
 
-	if b.hsmBroker == nil {
-		return fmt.Errorf("hsm broker not initialized")
+	return b.verify(ctx, hsm, r, verifyMethod(r, pin), pin)
+}
+
+// verifyMethod returns the verification method of the request, or else the
+// method of the BIN range.
+func verifyMethod(r bintable.Range, pin *domain.PIN) string {
+	if pin.Method != "" {
+		return pin.Method
 	}
+	return r.Method
+}
 
-	command := bytes.Buffer{}
-	command.Write([]byte("DCU"))
-	command.Write([]byte(TPK_ENC))
-	command.Write([]byte(PVK_ENC))
-	command.Write([]byte(pin.EncryptedPIN))
-	command.Write([]byte("01"))
-	command.Write([]byte(pin.PAN)[len(pin.PAN)-13 : len(pin.PAN)-1])
-	command.Write([]byte("1"))
-	command.Write([]byte(pin.PVV))
+// verify verifies the PIN block with the method.
+func (b *basicPinService) verify(ctx context.Context, hsm broker.Broker, r bintable.Range, method string, pin *domain.PIN) error {
+	switch method {
+	case bintable.MethodVisaPVV:
+		return b.verifyPVV(ctx, hsm, r, pin)
+	case bintable.MethodIBMOffset:
+		return b.verifyOffset(ctx, hsm, r, pin)
+	case bintable.MethodComparison:
+		return b.verifyComparison(ctx, hsm, pin)
+	}
+	return fmt.Errorf("%s: %w", method, ErrUnsupportedMethod)
+}
 
-	response, e0 = b.hsmBroker.Send(command.Bytes())
+// verifyPVV verifies the PIN block against the Visa PVV.
+func (b *basicPinService) verifyPVV(ctx context.Context, hsm broker.Broker, r bintable.Range, pin *domain.PIN) (e0 error) {
+	block, format, account, e0 := encryptedPIN(pin)
 	if e0 != nil {
 		return e0
 	}
+	pinKey, e0 := b.key(ctx, pin.Key, keystore.TypeTPK, keystore.TypeZPK)
+	if e0 != nil {
+		return e0
+	}
+	pvk, e0 := b.key(ctx, r.PVK, keystore.TypePVK)
+	if e0 != nil {
+		return e0
+	}
+
+	return exec(ctx, hsm, thales.VerifyPVV{
+		Interchange: pinKey.Type == keystore.TypeZPK,
+		Key:         pinKey.Value,
+		PVK:         pvk.Value,
+		PINBlock:    block,
+		Format:      format,
+		Account:     account,
+		PVKI:        r.PVKI,
+		PVV:         pin.PVV,
+	}, &thales.VerifyResponse{})
+}
+
+// GeneratePVV calculates the Visa PVV of the PIN. An encrypted PIN block is
+// expected to be under the TPK or ZPK (FW command); a clear PIN, used in
+// development, is first encrypted under the LMK (BA command) and then passed
+// to DG.
+func (b *basicPinService) GeneratePVV(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	r, hsm, e1 := b.route(pin.PAN)
+	if e1 != nil {
+		return "", e1
+	}
+	return b.generatePVV(ctx, hsm, r, pin)
+}
+
+// generatePVV calculates the Visa PVV of the PIN block (FW command) or of
+// the clear PIN (BA and DG commands).
+func (b *basicPinService) generatePVV(ctx context.Context, hsm broker.Broker, r bintable.Range, pin *domain.PIN) (s0 string, e1 error) {
+	pvk, e1 := b.key(ctx, r.PVK, keystore.TypePVK)
+	if e1 != nil {
+		return "", e1
+	}
 
-	if string(response[:2]) != "DD" {
-		e0 = ErrInvalidResponse
+	var command thales.Command
+	if pin.EncryptedPIN != "" {
+		block, format, account, err := encryptedPIN(pin)
+		if err != nil {
+			return "", err
+		}
+		pinKey, err := b.key(ctx, pin.Key, keystore.TypeTPK, keystore.TypeZPK)
+		if err != nil {
+			return "", err
+		}
+		command = thales.GenerateCustomerPVV{
+			Key:      pinKey.Value,
+			PVK:      pvk.Value,
+			PINBlock: block,
+			Format:   format,
+			Account:  account,
+			PVKI:     r.PVKI,
+		}
 	} else {
-		code := string(response[2:4])
-		if code != "00" {
-			e0 = fmt.Errorf(HSMErrors[code], ErrHsmError)
+		account, err := accountNumber(pin.PAN, thales.FormatISO0)
+		if err != nil {
+			return "", err
+		}
+		lmkPIN, err := encryptPIN(ctx, hsm, r, pin, account)
+		if err != nil {
+			return "", err
+		}
+		command = thales.GeneratePVV{
+			PVK:     pvk.Value,
+			PIN:     lmkPIN,
+			Account: account,
+			PVKI:    r.PVKI,
 		}
 	}
 
-	return e0
+	response := thales.PVVResponse{}
+	if e1 = exec(ctx, hsm, command, &response); e1 != nil {
+		return "", e1
+	}
+	return response.PVV, nil
 }
-func (b *basicPinService) GeneratePVV(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
-	// TODO implement the business logic of GeneratePVV
-	return s0, e1
+
+// GenerateOffset calculates the IBM 3624 offset of the PIN. An encrypted PIN
+// block is expected to be under the TPK or ZPK (BK command); a clear PIN is
+// first encrypted under the LMK (BA command) and then passed to DE.
+func (b *basicPinService) GenerateOffset(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	r, hsm, e1 := b.route(pin.PAN)
+	if e1 != nil {
+		return "", e1
+	}
+	return b.generateOffset(ctx, hsm, r, pin)
+}
+
+// generateOffset calculates the IBM 3624 offset of the PIN block (BK
+// command) or of the clear PIN (BA and DE commands).
+func (b *basicPinService) generateOffset(ctx context.Context, hsm broker.Broker, r bintable.Range, pin *domain.PIN) (s0 string, e1 error) {
+	account, e1 := accountNumber(pin.PAN, thales.FormatISO0)
+	if e1 != nil {
+		return "", e1
+	}
+	params, e1 := offsetParams(r, pin, account)
+	if e1 != nil {
+		return "", e1
+	}
+	pvk, e1 := b.key(ctx, r.PVK, keystore.TypePVK)
+	if e1 != nil {
+		return "", e1
+	}
+
+	var command thales.Command
+	if pin.EncryptedPIN != "" {
+		block, format, pinAccount, err := encryptedPIN(pin)
+		if err != nil {
+			return "", err
+		}
+		pinKey, err := b.key(ctx, pin.Key, keystore.TypeTPK, keystore.TypeZPK)
+		if err != nil {
+			return "", err
+		}
+		params.Account = pinAccount
+		command = thales.GenerateCustomerOffset{
+			Interchange: pinKey.Type == keystore.TypeZPK,
+			Key:         pinKey.Value,
+			PVK:         pvk.Value,
+			PINBlock:    block,
+			Format:      format,
+			IBM:         params,
+		}
+	} else {
+		lmkPIN, err := encryptPIN(ctx, hsm, r, pin, account)
+		if err != nil {
+			return "", err
+		}
+		command = thales.GenerateOffset{
+			PVK: pvk.Value,
+			PIN: lmkPIN,
+			IBM: params,
+		}
+	}
+
+	response := thales.OffsetResponse{}
+	if e1 = exec(ctx, hsm, command, &response); e1 != nil {
+		return "", e1
+	}
+	return response.Offset, nil
+}
+
+// VerifyOffset verifies the PIN block against the IBM 3624 offset regardless
+// of the method of the BIN range.
+func (b *basicPinService) VerifyOffset(ctx context.Context, pin *domain.PIN) (e0 error) {
+	r, hsm, e0 := b.route(pin.PAN)
+	if e0 != nil {
+		return e0
+	}
+	return b.verifyOffset(ctx, hsm, r, pin)
+}
+
+// verifyOffset verifies the PIN block under the TPK (DA command) or ZPK
+// (EA command) against the IBM 3624 offset.
+func (b *basicPinService) verifyOffset(ctx context.Context, hsm broker.Broker, r bintable.Range, pin *domain.PIN) (e0 error) {
+	block, format, account, e0 := encryptedPIN(pin)
+	if e0 != nil {
+		return e0
+	}
+	validationAccount, e0 := accountNumber(pin.PAN, thales.FormatISO0)
+	if e0 != nil {
+		return e0
+	}
+	params, e0 := offsetParams(r, pin, validationAccount)
+	if e0 != nil {
+		return e0
+	}
+	params.Account = account
+	pinKey, e0 := b.key(ctx, pin.Key, keystore.TypeTPK, keystore.TypeZPK)
+	if e0 != nil {
+		return e0
+	}
+	pvk, e0 := b.key(ctx, r.PVK, keystore.TypePVK)
+	if e0 != nil {
+		return e0
+	}
+
+	return exec(ctx, hsm, thales.VerifyOffset{
+		Interchange:  pinKey.Type == keystore.TypeZPK,
+		Key:          pinKey.Value,
+		PVK:          pvk.Value,
+		MaxPINLength: r.MaxPINLength,
+		PINBlock:     block,
+		Format:       format,
+		IBM:          params,
+		Offset:       pin.Offset,
+	}, &thales.VerifyResponse{})
+}
+
+// VerifyComparison verifies the PIN block against the PIN stored under the
+// LMK regardless of the method of the BIN range.
+func (b *basicPinService) VerifyComparison(ctx context.Context, pin *domain.PIN) (e0 error) {
+	_, hsm, e0 := b.route(pin.PAN)
+	if e0 != nil {
+		return e0
+	}
+	return b.verifyComparison(ctx, hsm, pin)
+}
+
+// verifyComparison verifies the PIN block under the TPK (BC command) or ZPK
+// (BE command) by comparison with the PIN encrypted under the LMK.
+func (b *basicPinService) verifyComparison(ctx context.Context, hsm broker.Broker, pin *domain.PIN) (e0 error) {
+	block, format, account, e0 := encryptedPIN(pin)
+	if e0 != nil {
+		return e0
+	}
+	pinKey, e0 := b.key(ctx, pin.Key, keystore.TypeTPK, keystore.TypeZPK)
+	if e0 != nil {
+		return e0
+	}
+
+	return exec(ctx, hsm, thales.VerifyComparison{
+		Interchange: pinKey.Type == keystore.TypeZPK,
+		Key:         pinKey.Value,
+		PINBlock:    block,
+		Format:      format,
+		Account:     account,
+		PIN:         pin.LMKPIN,
+	}, &thales.VerifyResponse{})
+}
+
+// StorePIN re-encrypts the customer selected PIN block from the TPK (JC
+// command) or ZPK (JE command) to the LMK and returns the PIN to store for
+// verification by comparison.
+func (b *basicPinService) StorePIN(ctx context.Context, pin *domain.PIN) (s0 string, e1 error) {
+	_, hsm, e1 := b.route(pin.PAN)
+	if e1 != nil {
+		return "", e1
+	}
+	return b.storePIN(ctx, hsm, pin)
+}
+
+// storePIN re-encrypts the PIN block from the TPK or ZPK to the LMK.
+func (b *basicPinService) storePIN(ctx context.Context, hsm broker.Broker, pin *domain.PIN) (s0 string, e1 error) {
+	block, format, account, e1 := encryptedPIN(pin)
+	if e1 != nil {
+		return "", e1
+	}
+	pinKey, e1 := b.key(ctx, pin.Key, keystore.TypeTPK, keystore.TypeZPK)
+	if e1 != nil {
+		return "", e1
+	}
+
+	response := thales.EncryptPINResponse{}
+	e1 = exec(ctx, hsm, thales.TranslatePINToLMK{
+		Interchange: pinKey.Type == keystore.TypeZPK,
+		Key:         pinKey.Value,
+		PINBlock:    block,
+		Format:      format,
+		Account:     account,
+	}, &response)
+	if e1 != nil {
+		return "", e1
+	}
+	return response.PIN, nil
+}
+
+// ChangePIN changes the PIN of the card as one operation: the PIN block is
+// verified with the method of the request or of the BIN range, the new PIN
+// block is checked against the PIN policy, and the PVV, offset or PIN under
+// LMK of the new PIN, which replaces the stored one, is returned.
+func (b *basicPinService) ChangePIN(ctx context.Context, c *domain.PINChange) (p0 *domain.PIN, e1 error) {
+	r, hsm, e1 := b.route(c.PAN)
+	if e1 != nil {
+		return nil, e1
+	}
+	method := verifyMethod(r, &c.PIN)
+	if e1 = b.verify(ctx, hsm, r, method, &c.PIN); e1 != nil {
+		return nil, e1
+	}
+
+	pin := c.PIN
+	pin.EncryptedPIN = c.NewEncryptedPIN
+	lmkPIN, e1 := b.checkPINPolicy(ctx, hsm, r, &c.PIN, &pin)
+	if e1 != nil {
+		return nil, e1
+	}
+
+	p0 = &domain.PIN{RequestId: c.RequestId, PAN: c.PAN, Method: method}
+	switch method {
+	case bintable.MethodVisaPVV:
+		p0.PVV, e1 = b.generatePVV(ctx, hsm, r, &pin)
+	case bintable.MethodIBMOffset:
+		p0.Offset, e1 = b.generateOffset(ctx, hsm, r, &pin)
+	case bintable.MethodComparison:
+		p0.LMKPIN = lmkPIN
+	}
+	if e1 != nil {
+		return nil, e1
+	}
+	return p0, nil
+}
+
+// TranslatePIN re-encrypts the PIN block from the source TPK (CA command) or
+// ZPK (CC command) to the destination ZPK and returns the new PIN block.
+func (b *basicPinService) TranslatePIN(ctx context.Context, t *domain.Translation) (s0 string, e1 error) {
+	hsm, e1 := b.translationBroker(t.PAN)
+	if e1 != nil {
+		return "", e1
+	}
+
+	srcKey, e1 := b.key(ctx, t.SourceKey, keystore.TypeTPK, keystore.TypeZPK)
+	if e1 != nil {
+		return "", e1
+	}
+	dstKey, e1 := b.key(ctx, t.DestinationKey, keystore.TypeZPK)
+	if e1 != nil {
+		return "", e1
+	}
+	srcFormat, e1 := formatCode(t.SourceFormat)
+	if e1 != nil {
+		return "", e1
+	}
+	dstFormat, e1 := formatCode(t.DestinationFormat)
+	if e1 != nil {
+		return "", e1
+	}
+	account, e1 := translationAccount(t.PAN, srcFormat, dstFormat)
+	if e1 != nil {
+		return "", e1
+	}
+
+	response := thales.TranslatePINResponse{}
+	e1 = exec(ctx, hsm, thales.TranslatePIN{
+		Interchange:       srcKey.Type == keystore.TypeZPK,
+		SourceKey:         srcKey.Value,
+		DestinationKey:    dstKey.Value,
+		MaxPINLength:      12,
+		PINBlock:          t.EncryptedPIN,
+		SourceFormat:      srcFormat,
+		DestinationFormat: dstFormat,
+		Account:           account,
+	}, &response)
+	if e1 != nil {
+		return "", e1
+	}
+	return response.PINBlock, nil
+}
+
+// offsetParams fills in the IBM 3624 parameters. The parameters of the BIN
+// range take precedence over the request ones; if neither has them, a 4 digit
+// check length and the account number as validation data are used. The
+// decimalisation table has no default.
+func offsetParams(r bintable.Range, pin *domain.PIN, account string) (thales.IBM, error) {
+	p := thales.IBM{
+		CheckLength:         r.CheckLength,
+		Account:             account,
+		DecimalisationTable: r.DecimalisationTable,
+		ValidationData:      pin.ValidationData,
+	}
+	if p.CheckLength == 0 {
+		p.CheckLength = pin.CheckLength
+	}
+	if p.CheckLength == 0 {
+		p.CheckLength = 4
+	}
+	if p.DecimalisationTable == "" {
+		p.DecimalisationTable = pin.DecimalisationTable
+	}
+	if p.DecimalisationTable == "" {
+		return thales.IBM{}, ErrNoDecimalisation
+	}
+	if p.ValidationData == "" {
+		p.ValidationData = account
+	}
+	return p, nil
+}
+
+// encryptPIN encrypts the clear PIN under the LMK with the BA command. The
+// PIN length is the length of the request, or else the number of digits of
+// the clear PIN.
+func encryptPIN(ctx context.Context, hsm broker.Broker, r bintable.Range, pin *domain.PIN, account string) (string, error) {
+	// the PIN has its own number of digits unless the request gives its
+	// length, which a PIN with leading zeros needs
+	clearPIN := fmt.Sprintf("%0*d", pin.Length, pin.ClearPIN)
+	length := len(clearPIN)
+	if pin.ClearPIN < 0 || length < r.MinPINLength || length > r.MaxPINLength || (pin.Length > 0 && length != pin.Length) {
+		return "", ErrInvalidPIN
+	}
+
+	response := thales.EncryptPINResponse{}
+	if err := exec(ctx, hsm, thales.EncryptPIN{PIN: clearPIN, Account: account}, &response); err != nil {
+		return "", err
+	}
+	return response.PIN, nil
+}
+
+// route looks up the BIN range of the PAN and the broker of its HSM pool.
+func (b *basicPinService) route(pan string) (bintable.Range, broker.Broker, error) {
+	if b.bins == nil {
+		return bintable.Range{}, nil, fmt.Errorf("bin table not initialized")
+	}
+	r, err := b.bins.Lookup(pan)
+	if err != nil {
+		return r, nil, err
+	}
+	pool := r.Pool
+	if pool == "" {
+		pool = DefaultPool
+	}
+	hsm, err := b.broker(pool)
+	return r, hsm, err
+}
+
+// translationBroker returns the broker of the PAN's range. PIN blocks of
+// cards outside the BIN table, or without a PAN, go to the default pool.
+func (b *basicPinService) translationBroker(pan string) (broker.Broker, error) {
+	if pan == "" {
+		return b.broker(DefaultPool)
+	}
+	_, hsm, err := b.route(pan)
+	if errors.Is(err, bintable.ErrNotFound) {
+		return b.broker(DefaultPool)
+	}
+	return hsm, err
+}
+
+// broker returns the broker of the HSM pool.
+func (b *basicPinService) broker(pool string) (broker.Broker, error) {
+	hsm, ok := b.brokers[pool]
+	if !ok || hsm == nil {
+		return nil, fmt.Errorf("hsm broker %q not initialized", pool)
+	}
+	return hsm, nil
+}
+
+// exec sends the command to the HSM and decodes the response fields.
+func exec(ctx context.Context, hsm broker.Broker, command thales.Command, response thales.Response) error {
+	request, err := thales.Encode(command)
+	if err != nil {
+		return err
+	}
+	raw, err := hsm.SendContext(ctx, request)
+	if err != nil {
+		return err
+	}
+	err = thales.Decode(command, raw, response)
+	var hsmErr *thales.Error
+	if errors.As(err, &hsmErr) {
+		return NewHSMError(hsmErr.Command, hsmErr.Code)
+	}
+	return err
 }
 
 // NewBasicPinService returns a naive, stateless implementation of PinService.
-func NewBasicPinService(b broker.Broker) PinService {
+func NewBasicPinService(b Brokers, ks keystore.KeyStore, bt bintable.Table) PinService {
 	return &basicPinService{
-		hsmBroker: b,
+		brokers: b,
+		keys:    ks,
+		bins:    bt,
 	}
 }
 
 // New returns a PinService with all of the expected middleware wired in.
-func New(b broker.Broker, middleware []Middleware) PinService {
-	var svc PinService = NewBasicPinService(b)
+func New(b Brokers, ks keystore.KeyStore, bt bintable.Table, middleware []Middleware) PinService {
+	var svc PinService = NewBasicPinService(b, ks, bt)
 	for _, m := range middleware {
 		svc = m(svc)
 	}
@@ -0,0 +1,249 @@
+//go:build !production
+
+package service_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/andrei-cloud/pinservice/pkg/bintable"
+	"github.com/andrei-cloud/pinservice/pkg/broker"
+	"github.com/andrei-cloud/pinservice/pkg/domain"
+	"github.com/andrei-cloud/pinservice/pkg/hsmsim"
+	"github.com/andrei-cloud/pinservice/pkg/keystore"
+	"github.com/andrei-cloud/pinservice/pkg/pincrypto"
+	"github.com/andrei-cloud/pinservice/pkg/service"
+)
+
+// newBroker returns the broker of a simulator with the test LMK.
+func newBroker(t *testing.T) hsmsim.Broker {
+	t.Helper()
+	sim, err := hsmsim.New(service.LMK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := hsmsim.NewBroker(&hsmsim.Server{Simulator: sim})
+	t.Cleanup(b.Close)
+	return b
+}
+
+// newService returns the service of the simulator with the keys of
+// config/keys.json and a Visa PVV range of 4 to 6 digit PINs.
+func newService(t *testing.T) service.PinService {
+	t.Helper()
+	keys, err := keystore.NewMemoryStore(
+		keystore.Key{Name: "tpk", Version: 1, Type: keystore.TypeTPK, Value: "U" + service.TPK_ENC},
+		keystore.Key{Name: "pvk", Version: 1, Type: keystore.TypePVK, Value: "U" + service.PVK_ENC},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bins, err := bintable.NewTable(bintable.Range{
+		Prefix:       "423407",
+		Method:       bintable.MethodVisaPVV,
+		PVK:          domain.KeyRef{Name: "pvk"},
+		PVKI:         "1",
+		MaxPINLength: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.NewBasicPinService(service.Brokers{service.DefaultPool: newBroker(t)}, keys, bins)
+}
+
+// pinBlock returns the ISO 0 PIN block of the PIN under the TPK.
+func pinBlock(t *testing.T, pin string) string {
+	t.Helper()
+	tpk, _ := hex.DecodeString(service.TPK)
+	block, err := pincrypto.EncryptPINBlock(tpk, pin, service.PAN, pincrypto.ISO0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%X", block)
+}
+
+// TestService runs the service against the simulator.
+func TestService(t *testing.T) {
+	svc := newService(t)
+	ctx := context.Background()
+
+	pvv, err := svc.GeneratePVV(ctx, &domain.PIN{PAN: service.PAN, ClearPIN: 1234, Length: 4})
+	if err != nil || pvv != service.PVV {
+		t.Fatalf("GeneratePVV: got %q, %v, want %s", pvv, err, service.PVV)
+	}
+	pvk, _ := hex.DecodeString(service.PVK)
+	want, _ := pincrypto.PVV(pvk, service.PAN, "1", "48260")
+	if pvv, err := svc.GeneratePVV(ctx, &domain.PIN{PAN: service.PAN, ClearPIN: 48260}); err != nil || pvv != want {
+		t.Errorf("GeneratePVV without length: got %q, %v, want %s", pvv, err, want)
+	}
+	want, _ = pincrypto.PVV(pvk, service.PAN, "1", "0482")
+	if pvv, err := svc.GeneratePVV(ctx, &domain.PIN{PAN: service.PAN, ClearPIN: 482, Length: 4}); err != nil || pvv != want {
+		t.Errorf("GeneratePVV with a leading zero: got %q, %v, want %s", pvv, err, want)
+	}
+	if _, err := svc.GeneratePVV(ctx, &domain.PIN{PAN: service.PAN, ClearPIN: 482}); !errors.Is(err, service.ErrInvalidPIN) {
+		t.Errorf("GeneratePVV of 3 digits: got %v, want ErrInvalidPIN", err)
+	}
+
+	pin := &domain.PIN{
+		PAN:          service.PAN,
+		EncryptedPIN: service.PINBlock,
+		PVV:          service.PVV,
+		Key:          domain.KeyRef{Name: "tpk"},
+	}
+	if err := svc.Verify(ctx, pin); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	pin.PVV = "0000"
+	var hsmErr *service.HSMError
+	if err := svc.Verify(ctx, pin); !errors.As(err, &hsmErr) || !hsmErr.Decline {
+		t.Fatalf("Verify with a wrong PVV: got %v, want a decline", err)
+	}
+
+	// comparison with the PIN stored under the LMK
+	if pin.LMKPIN, err = svc.StorePIN(ctx, pin); err != nil {
+		t.Fatalf("StorePIN: %v", err)
+	}
+	pin.Method = bintable.MethodComparison
+	if err := svc.Verify(ctx, pin); err != nil {
+		t.Fatalf("Verify by comparison: %v", err)
+	}
+	otherLMKPIN, err := svc.StorePIN(ctx, &domain.PIN{PAN: service.PAN, EncryptedPIN: pinBlock(t, "4321"), Key: pin.Key})
+	if err != nil {
+		t.Fatalf("StorePIN: %v", err)
+	}
+	pin.LMKPIN = otherLMKPIN
+	if err := svc.VerifyComparison(ctx, pin); !errors.As(err, &hsmErr) || !hsmErr.Decline || hsmErr.Command != "BC" {
+		t.Fatalf("VerifyComparison with another PIN: got %v, want a BC decline", err)
+	}
+}
+
+// downBroker is the broker of a pool without a reachable HSM.
+type downBroker struct{}
+
+func (downBroker) Send(req []byte) ([]byte, error) {
+	return nil, broker.ErrNoTarget
+}
+
+func (downBroker) SendContext(ctx context.Context, req []byte) ([]byte, error) {
+	return nil, broker.ErrNoTarget
+}
+
+func TestTranslatePINPool(t *testing.T) {
+	keys, err := keystore.NewMemoryStore(
+		keystore.Key{Name: "tpk", Version: 1, Type: keystore.TypeTPK, Value: "U" + service.TPK_ENC},
+		keystore.Key{Name: "zpk", Version: 1, Type: keystore.TypeZPK, Value: "U" + service.TPK_ENC},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bins, err := bintable.NewTable(bintable.Range{
+		Prefix: "423407",
+		Method: bintable.MethodComparison,
+		Pool:   "backup",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.NewBasicPinService(service.Brokers{
+		service.DefaultPool: downBroker{},
+		"backup":            newBroker(t),
+	}, keys, bins)
+
+	translation := func(pan string) *domain.Translation {
+		return &domain.Translation{
+			SourceKey:      domain.KeyRef{Name: "tpk"},
+			DestinationKey: domain.KeyRef{Name: "zpk"},
+			PAN:            pan,
+			EncryptedPIN:   service.PINBlock,
+		}
+	}
+	if block, err := svc.TranslatePIN(context.Background(), translation(service.PAN)); err != nil || block != service.PINBlock {
+		t.Errorf("range pool: got %q, %v, want %s", block, err, service.PINBlock)
+	}
+	if _, err := svc.TranslatePIN(context.Background(), translation("5100000000000001")); !errors.Is(err, broker.ErrNoTarget) {
+		t.Errorf("PAN outside the BIN table: got %v, want the default pool", err)
+	}
+}
+
+func TestChangePIN(t *testing.T) {
+	svc := newService(t)
+	ctx := context.Background()
+	pvk, _ := hex.DecodeString(service.PVK)
+	account, _ := pincrypto.AccountNumber(service.PAN)
+	change := func(method, pin string) *domain.PINChange {
+		c := &domain.PINChange{
+			PIN: domain.PIN{
+				PAN:          service.PAN,
+				EncryptedPIN: service.PINBlock,
+				Key:          domain.KeyRef{Name: "tpk"},
+				Method:       method,
+				PVV:          service.PVV,
+
+				DecimalisationTable: service.DecimalisationTable,
+			},
+			NewEncryptedPIN: pinBlock(t, pin),
+		}
+		c.Offset, _ = pincrypto.IBMOffset(pvk, service.ClearPIN, account, service.DecimalisationTable)
+		return c
+	}
+
+	got, err := svc.ChangePIN(ctx, change("", "4826"))
+	if err != nil {
+		t.Fatalf("Visa PVV: %v", err)
+	}
+	if want, _ := pincrypto.PVV(pvk, service.PAN, "1", "4826"); got.Method != bintable.MethodVisaPVV || got.PVV != want {
+		t.Errorf("Visa PVV: got %+v, want PVV %s", got, want)
+	}
+
+	got, err = svc.ChangePIN(ctx, change(bintable.MethodIBMOffset, "48260"))
+	if err != nil {
+		t.Fatalf("IBM offset: %v", err)
+	}
+	if want, _ := pincrypto.IBMOffset(pvk, "48260", account, service.DecimalisationTable); got.Offset != want {
+		t.Errorf("IBM offset: got %+v, want offset %s", got, want)
+	}
+
+	c := change(bintable.MethodIBMOffset, "48260")
+	c.DecimalisationTable = ""
+	if _, err := svc.ChangePIN(ctx, c); !errors.Is(err, service.ErrNoDecimalisation) {
+		t.Errorf("no decimalisation table: got %v, want ErrNoDecimalisation", err)
+	}
+
+	c = change(bintable.MethodComparison, "4826")
+	if c.LMKPIN, err = svc.StorePIN(ctx, &c.PIN); err != nil {
+		t.Fatal(err)
+	}
+	got, err = svc.ChangePIN(ctx, c)
+	if err != nil {
+		t.Fatalf("comparison: %v", err)
+	}
+	verify := &domain.PIN{PAN: service.PAN, EncryptedPIN: c.NewEncryptedPIN, Key: c.Key, LMKPIN: got.LMKPIN}
+	if err := svc.VerifyComparison(ctx, verify); err != nil {
+		t.Errorf("comparison: the new PIN under LMK does not verify: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		c    *domain.PINChange
+	}{
+		{"old PIN", change("", service.ClearPIN)},
+		{"repeated digits", change("", "7777")},
+		{"ascending digits", change("", "123456")},
+		{"ascending digits from 0", change("", "01234")},
+		{"too long", change("", "4826159")},
+	} {
+		if _, err := svc.ChangePIN(ctx, tc.c); !errors.Is(err, service.ErrPINPolicy) {
+			t.Errorf("%s: got %v, want ErrPINPolicy", tc.name, err)
+		}
+	}
+
+	c = change("", "4826")
+	c.PVV = "0000"
+	var hsmErr *service.HSMError
+	if _, err := svc.ChangePIN(ctx, c); !errors.As(err, &hsmErr) || !hsmErr.Decline {
+		t.Errorf("wrong PVV: got %v, want a decline", err)
+	}
+}
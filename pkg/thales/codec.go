@@ -0,0 +1,319 @@
+// Package thales encodes payShield host commands and decodes their responses.
+package thales
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidField    = errors.New("invalid field")
+	ErrInvalidResponse = errors.New("response is not valid")
+)
+
+// Command is a host command. Code returns the two character command code,
+// EncodeFields writes the command fields that follow it.
+type Command interface {
+	Code() string
+	EncodeFields(e *Encoder)
+}
+
+// Response decodes the response fields that follow the error code.
+type Response interface {
+	DecodeFields(d *Decoder)
+}
+
+// Error is the error code returned by the HSM.
+type Error struct {
+	Command string
+	Code    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: hsm error code %s", e.Command, e.Code)
+}
+
+// FieldError reports an invalid field of a command or of a response.
+type FieldError struct {
+	Command string
+	Field   string
+	Reason  string
+	Err     error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Command, e.Field, e.Reason)
+}
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// ResponseCode returns the response code of the command code: the second
+// character of the command code plus one.
+func ResponseCode(code string) string {
+	if len(code) != 2 {
+		return ""
+	}
+	return string([]byte{code[0], code[1] + 1})
+}
+
+// Encode returns the command message: the command code followed by the
+// command fields.
+func Encode(c Command) ([]byte, error) {
+	e := &Encoder{command: c.Code()}
+	e.buf.WriteString(c.Code())
+	c.EncodeFields(e)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// Decode checks that data is the response of the command and decodes its
+// fields into r. An error code other than "00" is returned as *Error.
+func Decode(c Command, data []byte, r Response) error {
+	code := ResponseCode(c.Code())
+	if len(data) < 4 {
+		return &FieldError{Command: code, Field: "response", Reason: fmt.Sprintf("%d bytes is too short", len(data)), Err: ErrInvalidResponse}
+	}
+	if string(data[:2]) != code {
+		return &FieldError{Command: code, Field: "response code", Reason: fmt.Sprintf("got %q", data[:2]), Err: ErrInvalidResponse}
+	}
+	if errCode := string(data[2:4]); errCode != "00" {
+		return &Error{Command: c.Code(), Code: errCode}
+	}
+	if r == nil {
+		return nil
+	}
+	d := &Decoder{command: code, data: data[4:]}
+	r.DecodeFields(d)
+	return d.err
+}
+
+// Encoder writes the command fields, validating each of them. The first
+// invalid field stops the encoding.
+type Encoder struct {
+	command string
+	buf     bytes.Buffer
+	err     error
+}
+
+func (e *Encoder) fail(field, reason string, args ...interface{}) {
+	if e.err == nil {
+		e.err = &FieldError{Command: e.command, Field: field, Reason: fmt.Sprintf(reason, args...), Err: ErrInvalidField}
+	}
+}
+
+func (e *Encoder) write(v string) {
+	if e.err == nil {
+		e.buf.WriteString(v)
+	}
+}
+
+// Literal writes v as is.
+func (e *Encoder) Literal(v string) {
+	e.write(v)
+}
+
+// Numeric writes a field of exactly length decimal digits.
+func (e *Encoder) Numeric(field, v string, length int) {
+	if len(v) != length || !isNumeric(v) {
+		e.fail(field, "%q is not %dN", v, length)
+		return
+	}
+	e.write(v)
+}
+
+// Number writes the integer as a zero padded field of length digits.
+func (e *Encoder) Number(field string, v, length int) {
+	e.Numeric(field, fmt.Sprintf("%0*d", length, v), length)
+}
+
+// Hex writes a field of hexadecimal characters of one of the lengths.
+func (e *Encoder) Hex(field, v string, lengths ...int) {
+	if !isHex(v) || !hasLength(v, lengths) {
+		e.fail(field, "%q is not %sH", v, joinLengths(lengths))
+		return
+	}
+	e.write(v)
+}
+
+// Alpha writes a field of exactly length printable characters.
+func (e *Encoder) Alpha(field, v string, length int) {
+	if len(v) != length || !isPrintable(v) {
+		e.fail(field, "%q is not %dA", v, length)
+		return
+	}
+	e.write(v)
+}
+
+// Key writes a key encrypted under the LMK: a single length key (16H), a
+// double length key with its scheme tag ('U' or 'X' + 32H), a triple length
+// key ('T' or 'Y' + 48H) or a key block ('S'). A double length key without
+// a scheme tag is written with the 'U' variant scheme.
+func (e *Encoder) Key(field, v string) {
+	switch {
+	case len(v) == 16 && isHex(v):
+	case len(v) == 32 && isHex(v):
+		v = "U" + v
+	case len(v) == 33 && strings.ContainsRune("UX", rune(v[0])) && isHex(v[1:]):
+	case len(v) == 49 && strings.ContainsRune("TY", rune(v[0])) && isHex(v[1:]):
+	case len(v) > 1 && v[0] == 'S' && isPrintable(v):
+	default:
+		e.fail(field, "%q is not a key under LMK", v)
+		return
+	}
+	e.write(v)
+}
+
+// KeyPair writes a pair of single length keys (32H), as the Visa PVV
+// commands expect the PVK. The scheme tag of a double length key is dropped.
+func (e *Encoder) KeyPair(field, v string) {
+	if len(v) == 33 && strings.ContainsRune("UX", rune(v[0])) {
+		v = v[1:]
+	}
+	e.Hex(field, v, 32)
+}
+
+// LMKPIN writes a PIN encrypted under the LMK (LN or LN+1), as returned by
+// the BA, JC and JE commands.
+func (e *Encoder) LMKPIN(field, v string) {
+	if len(v) < 5 || !isNumeric(v) {
+		e.fail(field, "%q is not a pin under LMK", v)
+		return
+	}
+	e.write(v)
+}
+
+// Format writes the PIN block format code.
+func (e *Encoder) Format(field, v string) {
+	if _, ok := blockLengths[v]; !ok {
+		e.fail(field, "%q is not a supported pin block format", v)
+		return
+	}
+	e.write(v)
+}
+
+// PINBlock writes the encrypted PIN block of the format: ISO 4 blocks are
+// AES encrypted (32H), all the others are TDES encrypted (16H).
+func (e *Encoder) PINBlock(field, v, format string) {
+	length, ok := blockLengths[format]
+	if !ok {
+		e.fail(field, "unsupported pin block format %q", format)
+		return
+	}
+	e.Hex(field, v, length)
+}
+
+// Account writes the account number field of the PIN block format: 12N,
+// or for ISO 4 the PAN length (2N) followed by the full PAN.
+func (e *Encoder) Account(field, v, format string) {
+	if format != FormatISO4 {
+		e.Numeric(field, v, 12)
+		return
+	}
+	if len(v) < 14 || !isNumeric(v) || fmt.Sprintf("%02d", len(v)-2) != v[:2] {
+		e.fail(field, "%q is not a length prefixed pan", v)
+		return
+	}
+	e.write(v)
+}
+
+// Decoder reads the response fields. Reading past the end of the response
+// fails the decoding instead of panicking.
+type Decoder struct {
+	command string
+	data    []byte
+	err     error
+}
+
+func (d *Decoder) fail(field, reason string, args ...interface{}) {
+	if d.err == nil {
+		d.err = &FieldError{Command: d.command, Field: field, Reason: fmt.Sprintf(reason, args...), Err: ErrInvalidResponse}
+	}
+}
+
+func (d *Decoder) take(field string, n int) string {
+	if d.err != nil {
+		return ""
+	}
+	if n < 0 || len(d.data) < n {
+		d.fail(field, "%d bytes left, %d expected", len(d.data), n)
+		return ""
+	}
+	v := string(d.data[:n])
+	d.data = d.data[n:]
+	return v
+}
+
+// Remaining returns the number of bytes left to decode.
+func (d *Decoder) Remaining() int {
+	return len(d.data)
+}
+
+// Numeric reads a field of n decimal digits.
+func (d *Decoder) Numeric(field string, n int) string {
+	v := d.take(field, n)
+	if d.err == nil && !isNumeric(v) {
+		d.fail(field, "%q is not %dN", v, n)
+	}
+	return v
+}
+
+// Hex reads a field of n hexadecimal characters.
+func (d *Decoder) Hex(field string, n int) string {
+	v := d.take(field, n)
+	if d.err == nil && !isHex(v) {
+		d.fail(field, "%q is not %dH", v, n)
+	}
+	return v
+}
+
+// Alpha reads a field of n characters.
+func (d *Decoder) Alpha(field string, n int) string {
+	return d.take(field, n)
+}
+
+// Rest reads the remaining bytes as one field of at least min characters.
+func (d *Decoder) Rest(field string, min int) string {
+	if d.err == nil && len(d.data) < min {
+		d.fail(field, "%d bytes left, at least %d expected", len(d.data), min)
+		return ""
+	}
+	return d.take(field, len(d.data))
+}
+
+func isNumeric(v string) bool {
+	return strings.Trim(v, "0123456789") == ""
+}
+
+func isHex(v string) bool {
+	return strings.Trim(v, "0123456789ABCDEFabcdef") == ""
+}
+
+func isPrintable(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func hasLength(v string, lengths []int) bool {
+	for _, l := range lengths {
+		if len(v) == l {
+			return true
+		}
+	}
+	return false
+}
+
+func joinLengths(lengths []int) string {
+	s := make([]string, len(lengths))
+	for i, l := range lengths {
+		s[i] = fmt.Sprint(l)
+	}
+	return strings.Join(s, "/")
+}
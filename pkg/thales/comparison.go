@@ -0,0 +1,56 @@
+package thales
+
+// VerifyComparison is the BC command, or the BE command if the PIN block is
+// under a ZPK: verify a PIN by comparison with the PIN encrypted under the
+// LMK.
+type VerifyComparison struct {
+	Interchange bool
+	// Key is the TPK, or the ZPK of an interchange PIN.
+	Key      string
+	PINBlock string
+	Format   string
+	Account  string
+	// PIN is the stored PIN encrypted under the LMK.
+	PIN string
+}
+
+func (c VerifyComparison) Code() string {
+	if c.Interchange {
+		return "BE"
+	}
+	return "BC"
+}
+
+func (c VerifyComparison) EncodeFields(e *Encoder) {
+	e.Key("TPK/ZPK", c.Key)
+	e.PINBlock("PIN Block", c.PINBlock, c.Format)
+	e.Format("PIN Block Format Code", c.Format)
+	e.Account("Account Number", c.Account, c.Format)
+	e.LMKPIN("PIN", c.PIN)
+}
+
+// TranslatePINToLMK is the JC command, or the JE command if the PIN block
+// is under a ZPK: translate a PIN block to encryption under the LMK. The
+// response is an EncryptPINResponse.
+type TranslatePINToLMK struct {
+	Interchange bool
+	// Key is the TPK, or the ZPK of an interchange PIN.
+	Key      string
+	PINBlock string
+	Format   string
+	Account  string
+}
+
+func (c TranslatePINToLMK) Code() string {
+	if c.Interchange {
+		return "JE"
+	}
+	return "JC"
+}
+
+func (c TranslatePINToLMK) EncodeFields(e *Encoder) {
+	e.Key("TPK/ZPK", c.Key)
+	e.PINBlock("PIN Block", c.PINBlock, c.Format)
+	e.Format("PIN Block Format Code", c.Format)
+	e.Account("Account Number", c.Account, c.Format)
+}
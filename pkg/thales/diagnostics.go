@@ -0,0 +1,22 @@
+package thales
+
+// Diagnostics is the NC command: perform diagnostics. It has no fields and
+// no side effect, which makes it the keepalive of the HSM connections.
+type Diagnostics struct{}
+
+func (c Diagnostics) Code() string { return "NC" }
+
+func (c Diagnostics) EncodeFields(*Encoder) {}
+
+// DiagnosticsResponse is the ND response.
+type DiagnosticsResponse struct {
+	// LMKCheckValue is the check value of the LMK of the HSM.
+	LMKCheckValue string
+	// Firmware is the firmware number of the HSM, e.g. "1500-0017".
+	Firmware string
+}
+
+func (r *DiagnosticsResponse) DecodeFields(d *Decoder) {
+	r.LMKCheckValue = d.Numeric("LMK Check Value", 16)
+	r.Firmware = d.Rest("Firmware Number", 9)
+}
@@ -0,0 +1,23 @@
+package thales
+
+// PIN block format codes.
+const (
+	FormatISO0 = "01" // ISO 9564-1 format 0 (ANSI X9.8)
+	FormatISO1 = "05" // ISO 9564-1 format 1, no account number
+	FormatISO3 = "47" // ISO 9564-1 format 3
+	FormatISO4 = "48" // ISO 9564-1 format 4, AES
+)
+
+// blockLengths maps the supported PIN block formats to the length of their
+// encrypted PIN blocks.
+var blockLengths = map[string]int{
+	FormatISO0: 16,
+	FormatISO1: 16,
+	FormatISO3: 16,
+	FormatISO4: 32,
+}
+
+// BlockLength returns the length of the encrypted PIN block of the format.
+func BlockLength(format string) int {
+	return blockLengths[format]
+}
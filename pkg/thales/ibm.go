@@ -0,0 +1,121 @@
+package thales
+
+import "strings"
+
+// IBM 3624 parameters shared by the offset commands.
+type IBM struct {
+	CheckLength         int
+	Account             string
+	DecimalisationTable string
+	ValidationData      string
+}
+
+func (p IBM) encode(e *Encoder, format string) {
+	if p.CheckLength < 4 || p.CheckLength > 12 {
+		e.fail("Check Length", "%d is not between 4 and 12", p.CheckLength)
+		return
+	}
+	e.Number("Check Length", p.CheckLength, 2)
+	e.Account("Account Number", p.Account, format)
+	e.Numeric("Decimalisation Table", p.DecimalisationTable, 16)
+	e.Alpha("PIN Validation Data", p.ValidationData, 12)
+}
+
+// VerifyOffset is the DA command, or the EA command if the PIN block is
+// under a ZPK: verify a PIN using the IBM 3624 offset method.
+type VerifyOffset struct {
+	Interchange bool
+	// Key is the TPK, or the ZPK of an interchange PIN.
+	Key          string
+	PVK          string
+	MaxPINLength int
+	PINBlock     string
+	Format       string
+	IBM
+	Offset string
+}
+
+func (c VerifyOffset) Code() string {
+	if c.Interchange {
+		return "EA"
+	}
+	return "DA"
+}
+
+func (c VerifyOffset) EncodeFields(e *Encoder) {
+	e.Key("TPK/ZPK", c.Key)
+	e.Key("PVK", c.PVK)
+	e.Number("Maximum PIN Length", c.MaxPINLength, 2)
+	e.PINBlock("PIN Block", c.PINBlock, c.Format)
+	e.Format("PIN Block Format Code", c.Format)
+	c.IBM.encode(e, c.Format)
+	encodeOffset(e, c.Offset)
+}
+
+// GenerateOffset is the DE command: generate the IBM 3624 offset of a PIN
+// encrypted under the LMK.
+type GenerateOffset struct {
+	PVK string
+	PIN string
+	IBM
+}
+
+func (c GenerateOffset) Code() string { return "DE" }
+
+func (c GenerateOffset) EncodeFields(e *Encoder) {
+	e.Key("PVK", c.PVK)
+	e.LMKPIN("PIN", c.PIN)
+	c.IBM.encode(e, FormatISO0)
+}
+
+// GenerateCustomerOffset is the BK command: generate the IBM 3624 offset of
+// a customer selected PIN.
+type GenerateCustomerOffset struct {
+	Interchange bool
+	// Key is the TPK, or the ZPK of an interchange PIN.
+	Key      string
+	PVK      string
+	PINBlock string
+	Format   string
+	IBM
+}
+
+func (c GenerateCustomerOffset) Code() string { return "BK" }
+
+func (c GenerateCustomerOffset) EncodeFields(e *Encoder) {
+	// key type: 001 - ZPK, 002 - TPK
+	if c.Interchange {
+		e.Literal("001")
+	} else {
+		e.Literal("002")
+	}
+	e.Key("TPK/ZPK", c.Key)
+	e.Key("PVK", c.PVK)
+	e.PINBlock("PIN Block", c.PINBlock, c.Format)
+	e.Format("PIN Block Format Code", c.Format)
+	c.IBM.encode(e, c.Format)
+}
+
+// OffsetResponse is the DF and BL response.
+type OffsetResponse struct {
+	// Offset is left justified, without the F padding.
+	Offset string
+}
+
+func (r *OffsetResponse) DecodeFields(d *Decoder) {
+	offset := d.Alpha("Offset", 12)
+	r.Offset = strings.TrimRight(offset, "F")
+	if !isNumeric(r.Offset) {
+		d.fail("Offset", "%q is not an offset", offset)
+	}
+}
+
+// encodeOffset writes the offset left justified and padded with F to 12
+// characters.
+func encodeOffset(e *Encoder, offset string) {
+	if len(offset) < 4 || len(offset) > 12 || !isNumeric(offset) {
+		e.fail("Offset", "%q is not 4 to 12 digits", offset)
+		return
+	}
+	e.Literal(offset + strings.Repeat("F", 12-len(offset)))
+}
@@ -0,0 +1,36 @@
+package thales
+
+// EncryptPIN is the BA command: encrypt a clear PIN under the LMK.
+type EncryptPIN struct {
+	PIN     string
+	Account string
+}
+
+func (c EncryptPIN) Code() string { return "BA" }
+
+func (c EncryptPIN) EncodeFields(e *Encoder) {
+	if len(c.PIN) < 4 || len(c.PIN) > 12 || !isNumeric(c.PIN) {
+		e.fail("PIN", "pin must be 4 to 12 digits")
+		return
+	}
+	// left justified and padded with F to the length of the encrypted PIN
+	e.Literal(c.PIN + "F")
+	e.Numeric("Account Number", c.Account, 12)
+}
+
+// EncryptPINResponse is the BB response, and the JD and JF response of
+// TranslatePINToLMK.
+type EncryptPINResponse struct {
+	// PIN is encrypted under the LMK.
+	PIN string
+}
+
+func (r *EncryptPINResponse) DecodeFields(d *Decoder) {
+	r.PIN = d.Rest("PIN", 5)
+}
+
+// VerifyResponse is the response of the verification commands, which has no
+// fields besides the error code.
+type VerifyResponse struct{}
+
+func (r *VerifyResponse) DecodeFields(*Decoder) {}
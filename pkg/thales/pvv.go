@@ -0,0 +1,82 @@
+package thales
+
+// VerifyPVV is the DC command, or the EC command if the PIN block is under a
+// ZPK: verify a PIN using the Visa PVV method.
+type VerifyPVV struct {
+	Interchange bool
+	// Key is the TPK, or the ZPK of an interchange PIN.
+	Key      string
+	PVK      string
+	PINBlock string
+	Format   string
+	Account  string
+	PVKI     string
+	PVV      string
+}
+
+func (c VerifyPVV) Code() string {
+	if c.Interchange {
+		return "EC"
+	}
+	return "DC"
+}
+
+func (c VerifyPVV) EncodeFields(e *Encoder) {
+	e.Key("TPK/ZPK", c.Key)
+	e.KeyPair("PVK Pair", c.PVK)
+	e.PINBlock("PIN Block", c.PINBlock, c.Format)
+	e.Format("PIN Block Format Code", c.Format)
+	e.Account("Account Number", c.Account, c.Format)
+	e.Numeric("PVKI", c.PVKI, 1)
+	e.Numeric("PVV", c.PVV, 4)
+}
+
+// GeneratePVV is the DG command: generate the Visa PVV of a PIN encrypted
+// under the LMK.
+type GeneratePVV struct {
+	PVK     string
+	PIN     string
+	Account string
+	PVKI    string
+}
+
+func (c GeneratePVV) Code() string { return "DG" }
+
+func (c GeneratePVV) EncodeFields(e *Encoder) {
+	e.KeyPair("PVK Pair", c.PVK)
+	e.LMKPIN("PIN", c.PIN)
+	e.Numeric("Account Number", c.Account, 12)
+	e.Numeric("PVKI", c.PVKI, 1)
+}
+
+// GenerateCustomerPVV is the FW command: generate the Visa PVV of a customer
+// selected PIN.
+type GenerateCustomerPVV struct {
+	// Key is the TPK or the ZPK.
+	Key      string
+	PVK      string
+	PINBlock string
+	Format   string
+	Account  string
+	PVKI     string
+}
+
+func (c GenerateCustomerPVV) Code() string { return "FW" }
+
+func (c GenerateCustomerPVV) EncodeFields(e *Encoder) {
+	e.Key("TPK/ZPK", c.Key)
+	e.KeyPair("PVK Pair", c.PVK)
+	e.PINBlock("PIN Block", c.PINBlock, c.Format)
+	e.Format("PIN Block Format Code", c.Format)
+	e.Account("Account Number", c.Account, c.Format)
+	e.Numeric("PVKI", c.PVKI, 1)
+}
+
+// PVVResponse is the DH and FX response.
+type PVVResponse struct {
+	PVV string
+}
+
+func (r *PVVResponse) DecodeFields(d *Decoder) {
+	r.PVV = d.Numeric("PVV", 4)
+}
@@ -0,0 +1,53 @@
+package thales
+
+// TranslatePIN is the CA command, or the CC command if the source key is a
+// ZPK: translate a PIN block to the destination ZPK.
+type TranslatePIN struct {
+	Interchange bool
+	// SourceKey is the TPK, or the ZPK of an interchange PIN.
+	SourceKey         string
+	DestinationKey    string
+	MaxPINLength      int
+	PINBlock          string
+	SourceFormat      string
+	DestinationFormat string
+	Account           string
+}
+
+func (c TranslatePIN) Code() string {
+	if c.Interchange {
+		return "CC"
+	}
+	return "CA"
+}
+
+func (c TranslatePIN) EncodeFields(e *Encoder) {
+	e.Key("Source TPK/ZPK", c.SourceKey)
+	e.Key("Destination ZPK", c.DestinationKey)
+	e.Number("Maximum PIN Length", c.MaxPINLength, 2)
+	e.PINBlock("Source PIN Block", c.PINBlock, c.SourceFormat)
+	e.Format("Source PIN Block Format Code", c.SourceFormat)
+	e.Format("Destination PIN Block Format Code", c.DestinationFormat)
+	format := c.SourceFormat
+	if c.DestinationFormat == FormatISO4 {
+		format = FormatISO4
+	}
+	e.Account("Account Number", c.Account, format)
+}
+
+// TranslatePINResponse is the CB and CD response.
+type TranslatePINResponse struct {
+	PINLength string
+	PINBlock  string
+	Format    string
+}
+
+func (r *TranslatePINResponse) DecodeFields(d *Decoder) {
+	r.PINLength = d.Numeric("PIN Length", 2)
+	// the PIN block is 16H, or 32H for ISO 4
+	r.PINBlock = d.Hex("Destination PIN Block", d.Remaining()-2)
+	r.Format = d.Numeric("Destination PIN Block Format Code", 2)
+	if d.err == nil && BlockLength(r.Format) != len(r.PINBlock) {
+		d.fail("Destination PIN Block", "%d characters for format %q", len(r.PINBlock), r.Format)
+	}
+}